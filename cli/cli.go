@@ -3,28 +3,289 @@ package cli
 import (
 	"bufio"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
+	"unicode"
+
+	"github.com/chzyer/readline"
 )
 
-// ScanLines calls onInput for every line scanned from os.Stdin.
-func ScanLines(onInput func(line string) error) (err error) {
-	reader := bufio.NewReader(os.Stdin)
-	var ln string
+// ScanLines calls onInput for every line scanned from r.
+func ScanLines(r io.Reader, onInput func(line string) error) error {
+	return ScanLinesWithTimeout(r, 0, onInput)
+}
+
+// ScanLinesWithTimeout is similar to ScanLines but returns ErrScanTimeout
+// if no line is scanned from r within timeout. timeout == 0 disables
+// the timeout. Since reads can't be interrupted, the goroutine reading
+// from r remains blocked after a timeout until r is closed.
+func ScanLinesWithTimeout(
+	r io.Reader,
+	timeout time.Duration,
+	onInput func(line string) error,
+) error {
+	type result struct {
+		line string
+		err  error
+	}
+	lines := make(chan result)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		reader := bufio.NewReader(r)
+		for {
+			ln, err := reader.ReadString('\n')
+			select {
+			case lines <- result{line: ln, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var timer *time.Timer
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer = time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
 	for {
-		ln, err = reader.ReadString('\n')
-		if err != nil {
+		var res result
+		select {
+		case res = <-lines:
+		case <-timedOut:
+			return ErrScanTimeout
+		}
+		if res.line != "" {
+			// A final line without a trailing newline
+			// is read together with the error
+			ln := strings.Replace(res.line, "\n", "", -1)
+			if err := onInput(ln); err != nil {
+				if err == ErrAbortScan {
+					return nil
+				}
+				return err
+			}
+		}
+		if res.err != nil {
+			return res.err
+		}
+		if timer != nil {
+			timer.Reset(timeout)
+		}
+	}
+}
+
+var ErrScanTimeout = errors.New("timed out waiting for input")
+
+// ScanLinesFromFile is similar to ScanLines but reads lines from the file
+// at path and returns nil once the end of the file is reached.
+func ScanLinesFromFile(path string, onInput func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := ScanLines(f, onInput); !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// ScanLinesWithHistory is similar to ScanLines but reads lines using
+// readline, which provides line editing, a history persisted in histFile
+// and tab completion of completions. histFile == "" disables the history.
+// Reaching the end of the input or interrupting on an empty line
+// stops the scan without an error.
+func ScanLinesWithHistory(
+	histFile string,
+	completions []string,
+	onInput func(line string) error,
+) error {
+	items := make([]readline.PrefixCompleterInterface, len(completions))
+	for i, c := range completions {
+		items[i] = readline.PcItem(c)
+	}
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:       "> ",
+		HistoryFile:  histFile,
+		AutoComplete: readline.NewPrefixCompleter(items...),
+	})
+	if err != nil {
+		return fmt.Errorf("initializing readline: %w", err)
+	}
+	defer rl.Close()
+
+	for {
+		ln, err := rl.Readline()
+		switch {
+		case errors.Is(err, readline.ErrInterrupt):
+			if ln == "" {
+				return nil
+			}
+			continue
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
 			return err
 		}
-		ln = strings.Replace(ln, "\n", "", -1)
-		if err = onInput(ln); err != nil {
-			break
+		if err := onInput(ln); err != nil {
+			if err == ErrAbortScan {
+				return nil
+			}
+			return err
 		}
 	}
-	if err == ErrAbortScan {
-		err = nil
+}
+
+// DefaultHistoryFile returns the path of the default history file
+// ~/.eventlog_history or "" if the home directory can't be determined.
+func DefaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
 	}
-	return
+	return filepath.Join(home, ".eventlog_history")
+}
+
+// ParseCommand splits input on whitespace returning the first token as
+// command and the remaining tokens as args. Single and double quoted
+// strings are treated as a single token, e.g. `put 5 "red apple"`
+// yields command "put" and args ["5", "red apple"].
+func ParseCommand(input string) (command string, args []string, err error) {
+	var tokens []string
+	var b strings.Builder
+	var quote rune
+	inToken := false
+	for _, r := range input {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				continue
+			}
+			b.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inToken = r, true
+		case unicode.IsSpace(r):
+			if inToken {
+				tokens = append(tokens, b.String())
+				b.Reset()
+				inToken = false
+			}
+		default:
+			b.WriteRune(r)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return "", nil, ErrUnterminatedQuote
+	}
+	if inToken {
+		tokens = append(tokens, b.String())
+	}
+	if len(tokens) < 1 {
+		return "", nil, ErrEmptyInput
+	}
+	return tokens[0], tokens[1:], nil
 }
 
 var ErrAbortScan = errors.New("abort scan")
+var ErrUnterminatedQuote = errors.New("unterminated quote")
+var ErrEmptyInput = errors.New("empty input")
+
+// MultiCommand routes input lines to registered command handlers.
+// The zero value is ready to use.
+type MultiCommand struct {
+	names    []string
+	handlers map[string]func(args []string) error
+	help     map[string]string
+}
+
+// Register registers fn as the handler of command name.
+func (m *MultiCommand) Register(name string, fn func(args []string) error) {
+	if m.handlers == nil {
+		m.handlers = map[string]func(args []string) error{}
+	}
+	if _, ok := m.handlers[name]; !ok {
+		m.names = append(m.names, name)
+	}
+	m.handlers[name] = fn
+}
+
+// Describe sets the arguments and description of command name
+// that are listed by Help.
+func (m *MultiCommand) Describe(name, args, description string) {
+	if m.help == nil {
+		m.help = map[string]string{}
+	}
+	usage := name
+	if args != "" {
+		usage += " " + args
+	}
+	m.help[name] = usage + ": " + description
+}
+
+// Dispatch parses line using ParseCommand and calls the handler
+// registered for the command. ErrUnknownCommand is returned
+// if no handler is registered for the command.
+func (m *MultiCommand) Dispatch(line string) error {
+	command, args, err := ParseCommand(line)
+	if err != nil {
+		return err
+	}
+	fn, ok := m.handlers[command]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownCommand, command)
+	}
+	return fn(args)
+}
+
+// Names returns the names of all registered commands
+// in order of registration.
+func (m *MultiCommand) Names() []string {
+	return append([]string(nil), m.names...)
+}
+
+// Help returns a list of all registered commands in order of registration.
+func (m *MultiCommand) Help() string {
+	var b strings.Builder
+	for _, n := range m.names {
+		b.WriteString("  ")
+		if h, ok := m.help[n]; ok {
+			b.WriteString(h)
+		} else {
+			b.WriteString(n)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+var ErrUnknownCommand = errors.New("unknown command")
+
+// NewLogger creates a logger writing records at or above level to w
+// in the given format, which is either "text" or "json".
+func NewLogger(
+	w io.Writer,
+	format string,
+	level slog.Leveler,
+) (*slog.Logger, error) {
+	o := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, o)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, o)), nil
+	}
+	return nil, fmt.Errorf("unknown log format: %q", format)
+}
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanLinesFinalLineWithoutNewline(t *testing.T) {
+	var lines []string
+	err := ScanLines(strings.NewReader("a\n\nb"), func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	want := []string{"a", "", "b"}
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected %q, got %q", want, lines)
+	}
+}
+
+func TestScanLinesWithTimeoutSlowReader(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	go func() { w.Write([]byte("a\n")) }()
+
+	var lines []string
+	err := ScanLinesWithTimeout(r, 20*time.Millisecond, func(l string) error {
+		lines = append(lines, l)
+		return nil
+	})
+	if !errors.Is(err, ErrScanTimeout) {
+		t.Fatalf("expected ErrScanTimeout, got %v", err)
+	}
+	if len(lines) != 1 || lines[0] != "a" {
+		t.Fatalf("expected the line scanned before the timeout, got %q", lines)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var b bytes.Buffer
+	l, err := NewLogger(&b, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatalf("creating json logger: %v", err)
+	}
+	l.Debug("ignored")
+	l.Info("synced", slog.String("version", "0a"))
+	var record map[string]any
+	if err := json.Unmarshal(b.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q: %v", b.String(), err)
+	}
+	if record["msg"] != "synced" || record["version"] != "0a" {
+		t.Fatalf("unexpected record: %v", record)
+	}
+
+	b.Reset()
+	if l, err = NewLogger(&b, "text", slog.LevelInfo); err != nil {
+		t.Fatalf("creating text logger: %v", err)
+	}
+	l.Info("synced", slog.String("version", "0a"))
+	if s := b.String(); !strings.Contains(s, "msg=synced version=0a") {
+		t.Fatalf("unexpected text record: %q", s)
+	}
+
+	if _, err := NewLogger(&b, "xml", slog.LevelInfo); err == nil {
+		t.Fatalf("expected an unknown format to be rejected")
+	}
+}
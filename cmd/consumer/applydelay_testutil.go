@@ -0,0 +1,16 @@
+//go:build testutil
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SetApplyDelay makes the consumer sleep for d before applying each event
+// to simulate a slow consumer. A zero duration disables the delay.
+//
+// FOR TESTING ONLY: only available in builds with the testutil tag.
+func (c *Consumer) SetApplyDelay(d time.Duration) {
+	atomic.StoreInt64(&c.applyDelay, int64(d))
+}
@@ -0,0 +1,47 @@
+//go:build testutil
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/romshark/eventlog-example/event"
+)
+
+func TestSetApplyDelay(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+	for i := 0; i < 3; i++ {
+		appendEvent(t, c, event.Event{
+			Operation: "put", Object: "apple", Quantity: 1,
+		})
+	}
+
+	s.SetApplyDelay(20 * time.Millisecond)
+	start := time.Now()
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Fatalf("expected each event to be delayed, took %s", d)
+	}
+
+	s.SetApplyDelay(0)
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 1,
+	})
+	start = time.Now()
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if d := time.Since(start); d >= 20*time.Millisecond {
+		t.Fatalf("expected the delay to be disabled, took %s", d)
+	}
+	if q, err := s.Quantity("apple"); err != nil {
+		t.Fatalf("reading quantity: %v", err)
+	} else if q != 4 {
+		t.Fatalf("expected 4, got %d", q)
+	}
+}
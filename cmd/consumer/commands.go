@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/romshark/eventlog-example/cli"
+	"github.com/romshark/eventlog-example/database"
+
+	"github.com/romshark/eventlog/client"
+)
+
+// registerCommands registers all CLI commands of the consumer.
+// pageSize limits the number of objects printed by the print command.
+func registerCommands(m *cli.MultiCommand, c *Consumer, pageSize int) {
+	registerPrint(m, c, pageSize)
+	registerCheckIntegrity(m, c)
+	registerRunExpiry(m, c)
+	registerRebuild(m, c)
+	registerExportNDJSON(m, c)
+	registerSnapshot(m, c)
+	registerRestoreSnapshot(m, c)
+	registerWait(m, c)
+	registerSeal(m, c)
+	registerUnseal(m, c)
+	registerMerge(m, c)
+	registerChanges(m, c)
+	registerSyncWait(m, c)
+	registerHistory(m, c)
+	registerAudit(m, c)
+	registerStatus(m, c)
+	registerDBStats(m, c.db)
+	registerLock(m, c)
+	registerStats(m, c)
+	registerRollback(m, c)
+	registerExit(m)
+}
+
+func registerPrint(m *cli.MultiCommand, c *Consumer, pageSize int) {
+	m.Describe(
+		"print", "[--sort[=desc|asc]] [cursor]",
+		"prints the current state of the world",
+	)
+	m.Register("print", func(args []string) error {
+		if len(args) > 0 && strings.HasPrefix(args[0], "--sort") {
+			var order database.SortOrder
+			switch args[0] {
+			case "--sort", "--sort=desc":
+				order = database.SortByQuantityDesc
+			case "--sort=asc":
+				order = database.SortByQuantityAsc
+			default:
+				fmt.Println("  usage: print [--sort[=desc|asc]] [cursor]")
+				return nil
+			}
+			return printSorted(c, order, pageSize)
+		}
+		var cursor string
+		if len(args) > 0 {
+			cursor = strings.Join(args, " ")
+		}
+		next, err := c.ScanDBPage(cursor, pageSize, func(
+			v client.Version,
+		) (resume bool) {
+			if v == "" {
+				c.log().Info("projection version: log empty")
+			} else {
+				c.log().Info("projection version", slog.String("version", v))
+			}
+			return true
+		}, func(object string, num int64) (resume bool) {
+			fmt.Printf(" %s: %d\n", object, num)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if next != "" {
+			fmt.Printf("  next page: print %s\n", next)
+		}
+		return nil
+	})
+}
+
+// printSorted prints at most limit objects in the given order.
+// A limit below 1 disables the limit.
+func printSorted(c *Consumer, order database.SortOrder, limit int) error {
+	return c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		printed := 0
+		return tx.ScanObjectsSorted(
+			order, func(object string, quantity int64) error {
+				if limit > 0 && printed >= limit {
+					return database.ErrAbortScan
+				}
+				printed++
+				fmt.Printf(" %s: %d\n", object, quantity)
+				return nil
+			},
+		)
+	})
+}
+
+func registerCheckIntegrity(m *cli.MultiCommand, c *Consumer) {
+	m.Describe(
+		"check-integrity", "[--fix]", "checks (and fixes) the database",
+	)
+	m.Register("check-integrity", func(args []string) error {
+		check := c.db.CheckIntegrity
+		if hasFlag(args, "--fix") {
+			check = c.db.FixIntegrity
+		}
+		issues, err := check(context.Background())
+		if err != nil {
+			return err
+		}
+		if len(issues) < 1 {
+			fmt.Println("  no integrity issues found")
+		}
+		for _, i := range issues {
+			fmt.Printf("  %s\n", i)
+		}
+		return nil
+	})
+}
+
+func registerRunExpiry(m *cli.MultiCommand, c *Consumer) {
+	m.Describe("run-expiry", "", "drains all expired objects")
+	m.Register("run-expiry", func(args []string) error {
+		return c.RunExpiry(context.Background())
+	})
+}
+
+func registerRebuild(m *cli.MultiCommand, c *Consumer) {
+	m.Describe(
+		"rebuild", "[--progress]", "rebuilds the database from the log",
+	)
+	m.Register("rebuild", func(args []string) error {
+		progress := func(int64) {}
+		if hasFlag(args, "--progress") {
+			progress = func(n int64) {
+				fmt.Printf("  Rebuilding... %d events processed\n", n)
+			}
+		}
+		var total int64
+		if err := c.Rebuild(context.Background(), func(n int64) {
+			total = n
+			progress(n)
+		}); err != nil {
+			return err
+		}
+		fmt.Printf("  rebuilt from %d events\n", total)
+		return nil
+	})
+}
+
+func registerExportNDJSON(m *cli.MultiCommand, c *Consumer) {
+	m.Describe("export-ndjson", "<file|->", "exports the state as NDJSON")
+	m.Register("export-ndjson", func(args []string) error {
+		if len(args) != 1 {
+			fmt.Println("  usage: export-ndjson <file|->")
+			return nil
+		}
+		if args[0] == "-" {
+			return c.ExportNDJSON(context.Background(), os.Stdout)
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return fmt.Errorf("creating export file: %w", err)
+		}
+		defer f.Close()
+		return c.ExportNDJSON(context.Background(), f)
+	})
+}
+
+func registerSnapshot(m *cli.MultiCommand, c *Consumer) {
+	m.Describe("snapshot", "<file>", "writes a JSON snapshot of the state")
+	m.Register("snapshot", func(args []string) error {
+		if len(args) != 1 {
+			fmt.Println("  usage: snapshot <file>")
+			return nil
+		}
+		s, err := c.Snapshot(context.Background())
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(args[0], b, 0o644); err != nil {
+			return fmt.Errorf("writing snapshot file: %w", err)
+		}
+		fmt.Printf("  snapshot at version %s written\n", s.Version)
+		return nil
+	})
+}
+
+func registerRestoreSnapshot(m *cli.MultiCommand, c *Consumer) {
+	m.Describe(
+		"restore-snapshot", "<file>",
+		"restores a JSON snapshot and synchronizes",
+	)
+	m.Register("restore-snapshot", func(args []string) error {
+		if len(args) != 1 {
+			fmt.Println("  usage: restore-snapshot <file>")
+			return nil
+		}
+		b, err := os.ReadFile(args[0])
+		if err != nil {
+			return fmt.Errorf("reading snapshot file: %w", err)
+		}
+		var s ProjectionSnapshot
+		if err := json.Unmarshal(b, &s); err != nil {
+			fmt.Printf("  malformed snapshot: %s\n", err)
+			return nil
+		}
+		err = c.RestoreFromSnapshot(context.Background(), &s)
+		if errors.Is(err, ErrSnapshotCorrupted) {
+			fmt.Printf("  %s\n", err)
+			return nil
+		}
+		return err
+	})
+}
+
+func registerWait(m *cli.MultiCommand, c *Consumer) {
+	m.Describe(
+		"wait", "<object> <min>", "waits until there are enough objects",
+	)
+	m.Register("wait", func(args []string) error {
+		if len(args) != 2 {
+			fmt.Println("  usage: wait <object> <min>")
+			return nil
+		}
+		minQuantity, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fmt.Printf("  parsing number: %s\n", err)
+			return nil
+		}
+		if err := c.WaitForObject(
+			context.Background(), args[0], minQuantity,
+		); err != nil {
+			return err
+		}
+		q, err := c.Quantity(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf(" %s: %d\n", args[0], q)
+		return nil
+	})
+}
+
+func registerSeal(m *cli.MultiCommand, c *Consumer) {
+	m.Describe("seal", "", "makes the database read-only")
+	m.Register("seal", func(args []string) error {
+		if err := c.db.Seal(context.Background()); err != nil {
+			if errors.Is(err, database.ErrDatabaseSealed) {
+				fmt.Println("  database is already sealed")
+				return nil
+			}
+			return err
+		}
+		fmt.Println("  database sealed")
+		return nil
+	})
+}
+
+func registerUnseal(m *cli.MultiCommand, c *Consumer) {
+	m.Describe(
+		"unseal", "<reason>", "makes a sealed database writable again",
+	)
+	m.Register("unseal", func(args []string) error {
+		if len(args) < 1 {
+			fmt.Println("  usage: unseal <reason>")
+			return nil
+		}
+		if err := c.db.Unseal(strings.Join(args, " ")); err != nil {
+			if errors.Is(err, database.ErrNotSealed) {
+				fmt.Println("  database isn't sealed")
+				return nil
+			}
+			return err
+		}
+		fmt.Println("  database unsealed")
+		return nil
+	})
+}
+
+func registerMerge(m *cli.MultiCommand, c *Consumer) {
+	m.Describe(
+		"merge", "<other-db-dir> [--strategy ours|theirs|timestamps]",
+		"merges another database into the database",
+	)
+	m.Register("merge", func(args []string) error {
+		var dir, strategyName string
+		for i := 0; i < len(args); i++ {
+			if args[i] == "--strategy" && i+1 < len(args) {
+				i++
+				strategyName = args[i]
+				continue
+			}
+			dir = args[i]
+		}
+		if dir == "" {
+			fmt.Println("  usage: merge <other-db-dir> " +
+				"[--strategy ours|theirs|timestamps]")
+			return nil
+		}
+
+		var strategy database.MergeStrategy
+		switch strategyName {
+		case "ours":
+			strategy = database.MergeOurs
+		case "theirs":
+			strategy = database.MergeTheirs
+		case "timestamps", "":
+		default:
+			fmt.Printf("  unknown merge strategy: %q\n", strategyName)
+			return nil
+		}
+
+		other, err := database.NewReadOnlyDB(
+			dir, slog.New(slog.NewTextHandler(io.Discard, nil)),
+		)
+		if err != nil {
+			fmt.Printf("  opening %q: %s\n", dir, err)
+			return nil
+		}
+		defer other.Close()
+		if err := c.db.Merge(
+			context.Background(), other, strategy,
+		); err != nil {
+			return err
+		}
+		fmt.Printf("  merged %q\n", dir)
+		return nil
+	})
+}
+
+func registerChanges(m *cli.MultiCommand, c *Consumer) {
+	m.Describe(
+		"changes", "<version>", "prints objects modified after a version",
+	)
+	m.Register("changes", func(args []string) error {
+		if len(args) != 1 {
+			fmt.Println("  usage: changes <version>")
+			return nil
+		}
+		changes, err := c.GetChangedObjects(context.Background(), args[0])
+		if err != nil {
+			return err
+		}
+		for _, ch := range changes {
+			fmt.Printf(" %s: %d (%s)\n", ch.Object, ch.Quantity, ch.LastVersion)
+		}
+		return nil
+	})
+}
+
+func registerSyncWait(m *cli.MultiCommand, c *Consumer) {
+	m.Describe(
+		"sync-wait", "<timeout>", "synchronizes and waits for new events",
+	)
+	m.Register("sync-wait", func(args []string) error {
+		if len(args) != 1 {
+			fmt.Println("  usage: sync-wait <timeout>")
+			return nil
+		}
+		timeout, err := time.ParseDuration(args[0])
+		if err != nil {
+			fmt.Printf("  parsing timeout: %s\n", err)
+			return nil
+		}
+		v, err := c.SyncAndWait(context.Background(), timeout)
+		if err != nil {
+			if errors.Is(err, ErrNoNewEvents) {
+				fmt.Printf("  no new events within %s\n", timeout)
+				return nil
+			}
+			return err
+		}
+		fmt.Printf("  synchronized to version %s\n", v)
+		return nil
+	})
+}
+
+func registerHistory(m *cli.MultiCommand, c *Consumer) {
+	m.Describe("history", "", "prints the last 20 version transitions")
+	m.Register("history", func(args []string) error {
+		var records []database.VersionRecord
+		if err := c.db.WithinTx(
+			database.ReadOnly,
+			func(tx *database.Tx) (err error) {
+				records, err = tx.GetProjectionVersionHistory()
+				return err
+			},
+		); err != nil {
+			return err
+		}
+		if len(records) > 20 {
+			records = records[len(records)-20:]
+		}
+		for _, r := range records {
+			fmt.Printf(
+				" %s: %s\n", r.AppliedAt.Format(time.RFC3339Nano), r.Version,
+			)
+		}
+		return nil
+	})
+}
+
+func registerAudit(m *cli.MultiCommand, c *Consumer) {
+	m.Describe("audit", "[limit]", "prints the most recent operations")
+	m.Register("audit", func(args []string) error {
+		limit := 20
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				fmt.Printf("  invalid limit: %q\n", args[0])
+				return nil
+			}
+			limit = n
+		}
+		entries, err := c.Audit(limit)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			fmt.Printf(
+				"  %s %s: %s %s %d\n",
+				e.AppliedAt.Format(time.RFC3339Nano), e.Version,
+				e.Operation, e.Object, e.Quantity,
+			)
+		}
+		return nil
+	})
+}
+
+func registerDBStats(m *cli.MultiCommand, db *database.DB) {
+	m.Describe("db-stats", "", "prints database storage statistics as JSON")
+	m.Register("db-stats", func(args []string) error {
+		s, err := db.Stats()
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(s, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  %s\n", b)
+		return nil
+	})
+}
+
+func registerLock(m *cli.MultiCommand, c *Consumer) {
+	unlock := map[string]database.UnlockFn{}
+
+	m.Describe("lock", "<object>", "locks an object")
+	m.Register("lock", func(args []string) error {
+		if len(args) != 1 {
+			fmt.Println("  usage: lock <object>")
+			return nil
+		}
+		if _, ok := unlock[args[0]]; ok {
+			fmt.Printf("  %s is already locked\n", args[0])
+			return nil
+		}
+		fn, err := c.db.Lock(context.Background(), args[0])
+		if err != nil {
+			return err
+		}
+		unlock[args[0]] = fn
+		fmt.Printf("  locked %s\n", args[0])
+		return nil
+	})
+
+	m.Describe("unlock", "<object>", "unlocks an object")
+	m.Register("unlock", func(args []string) error {
+		if len(args) != 1 {
+			fmt.Println("  usage: unlock <object>")
+			return nil
+		}
+		fn, ok := unlock[args[0]]
+		if !ok {
+			fmt.Printf("  %s isn't locked\n", args[0])
+			return nil
+		}
+		delete(unlock, args[0])
+		if err := fn(); err != nil {
+			return err
+		}
+		fmt.Printf("  unlocked %s\n", args[0])
+		return nil
+	})
+}
+
+func registerStatus(m *cli.MultiCommand, c *Consumer) {
+	m.Describe("status", "", "prints the synchronization status")
+	m.Register("status", func(args []string) error {
+		s := c.Status()
+		lastSyncAt := "never"
+		if !s.LastSyncAt.IsZero() {
+			lastSyncAt = s.LastSyncAt.Format(time.RFC3339Nano)
+		}
+		fmt.Printf("  projection version: %s\n", s.ProjectionVersion)
+		fmt.Printf("  latest log version: %s\n", s.LatestLogVersion)
+		fmt.Printf("  versions behind:    %d\n", s.VersionsBehind)
+		fmt.Printf("  last sync at:       %s\n", lastSyncAt)
+		fmt.Printf("  syncing:            %t\n", s.IsSyncing)
+		return nil
+	})
+}
+
+func registerStats(m *cli.MultiCommand, c *Consumer) {
+	m.Describe("stats", "", "prints consumer statistics")
+	m.Register("stats", func(args []string) error {
+		s := c.Stats()
+		lastSyncAt := "never"
+		if !s.LastSyncAt.IsZero() {
+			lastSyncAt = s.LastSyncAt.Format(time.RFC3339Nano)
+		}
+		fmt.Printf("  events applied:     %d\n", s.EventsApplied)
+		fmt.Printf("  events skipped:     %d\n", s.EventsSkipped)
+		fmt.Printf("  syncs:              %d\n", s.SyncCount)
+		fmt.Printf("  last sync at:       %s\n", lastSyncAt)
+		fmt.Printf("  last sync duration: %s\n", s.LastSyncDuration)
+		fmt.Printf("  current version:    %s\n", s.CurrentVersion)
+		fmt.Printf("  objects:            %d\n", s.ObjectCount)
+		fmt.Printf("  errors:             %d\n", s.ErrorCount)
+		return printGCStats(c.db)
+	})
+}
+
+func registerRollback(m *cli.MultiCommand, c *Consumer) {
+	m.Describe(
+		"rollback", "<version> --confirm",
+		"resets the projection to its state at a version",
+	)
+	m.Register("rollback", func(args []string) error {
+		var version string
+		for _, a := range args {
+			if a != "--confirm" {
+				version = a
+			}
+		}
+		if version == "" {
+			fmt.Println("  usage: rollback <version> --confirm")
+			return nil
+		}
+		if !hasFlag(args, "--confirm") {
+			fmt.Println("  rollback is destructive, confirm using --confirm")
+			return nil
+		}
+		err := c.Rollback(context.Background(), version)
+		if errors.Is(err, database.ErrRollbackVersionNotReached) {
+			fmt.Printf("  version %s not found in the log\n", version)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  rolled back to version %s\n", version)
+		return nil
+	})
+}
+
+func registerExit(m *cli.MultiCommand) {
+	m.Describe("exit", "", "exits the program")
+	m.Register("exit", func(args []string) error {
+		return cli.ErrAbortScan
+	})
+}
+
+// printGCStats prints the value log GC statistics of db.
+func printGCStats(db *database.DB) error {
+	s, err := db.GCStats()
+	if err != nil {
+		return err
+	}
+	lastGCAt := "never"
+	if !s.LastGCAt.IsZero() {
+		lastGCAt = s.LastGCAt.Format(time.RFC3339Nano)
+	}
+	fmt.Printf("  GC runs:            %d\n", s.RunCount)
+	fmt.Printf("  GC bytes reclaimed: %d\n", s.BytesReclaimed)
+	fmt.Printf("  last GC at:         %s\n", lastGCAt)
+	fmt.Printf("  last GC duration:   %s\n", s.LastGCDuration)
+	return nil
+}
+
+// hasFlag returns true if flag is contained in args.
+func hasFlag(args []string, flag string) bool {
+	for _, a := range args {
+		if a == flag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// levelHandler is a slog.Handler dropping records below level
+// before passing them on to the wrapped handler.
+type levelHandler struct {
+	h     slog.Handler
+	level slog.Leveler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.h.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.h.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{h: h.h.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{h: h.h.WithGroup(name), level: h.level}
+}
@@ -2,25 +2,56 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/romshark/eventlog-example/cli"
+	"github.com/romshark/eventlog-example/config"
 	"github.com/romshark/eventlog-example/database"
 	"github.com/romshark/eventlog-example/event"
+	"github.com/romshark/eventlog-example/internal/projection"
+	"github.com/romshark/eventlog-example/internal/runner"
+	"github.com/romshark/eventlog-example/metrics"
+	"github.com/romshark/eventlog-example/otel"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/romshark/eventlog/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
 	var fHost string
 	var fDBDir string
 	var fEnableDBLog bool
+	var fDBStrict bool
+	var fGCInterval time.Duration
+	var fWarmUp bool
+	var fHistFile string
+	var fScript string
+	var fSyncTimeout time.Duration
+	var fRejectUnknown bool
+	var fBatchSize int
+	var fPageSize int
+	var fLogFormat string
+	var fMetricsAddr string
+	var fShutdownTimeout time.Duration
+	var fCLITimeout time.Duration
+	var fConfig string
 	flag.StringVar(
 		&fHost, "log-addr", "localhost:9090", "event log server address",
 	)
@@ -30,19 +61,120 @@ func main() {
 	flag.BoolVar(
 		&fEnableDBLog, "db-log", false, "enable database debug logging",
 	)
+	flag.BoolVar(
+		&fDBStrict, "db-strict", false, "enable strict consistency checks",
+	)
+	flag.DurationVar(
+		&fSyncTimeout, "sync-timeout", 0, "synchronization timeout (0=none)",
+	)
+	flag.BoolVar(
+		&fRejectUnknown, "reject-unknown-events", false,
+		"fail on events with unknown labels instead of skipping them",
+	)
+	flag.IntVar(
+		&fBatchSize, "catchup-batch-size", 100,
+		"number of events buffered per batch while synchronizing",
+	)
+	flag.IntVar(
+		&fPageSize, "page-size", 0,
+		"number of objects printed per page (0=all)",
+	)
+	flag.DurationVar(
+		&fGCInterval, "gc-interval", 5*time.Minute,
+		"database value log GC interval (0=disabled)",
+	)
+	flag.BoolVar(
+		&fWarmUp, "warmup-on-start", false,
+		"pre-fetch the database keyspace into the cache on start",
+	)
+	flag.StringVar(
+		&fHistFile, "history-file", cli.DefaultHistoryFile(),
+		"command history file (empty=disabled)",
+	)
+	flag.StringVar(
+		&fScript, "script", "",
+		"file to read commands from instead of the terminal",
+	)
+	flag.StringVar(
+		&fLogFormat, "log-format", "text", "log format (text or json)",
+	)
+	flag.StringVar(
+		&fMetricsAddr, "metrics-addr", "localhost:9101",
+		"address /metrics is served on (empty=disabled)",
+	)
+	flag.DurationVar(
+		&fShutdownTimeout, "shutdown-timeout", 10*time.Second,
+		"maximum time to wait for in-flight work to finish on shutdown",
+	)
+	flag.DurationVar(
+		&fCLITimeout, "cli-timeout", 0,
+		"read commands from stdin without line editing and exit "+
+			"if none is entered within this duration (0=disabled)",
+	)
+	flag.StringVar(
+		&fConfig, "config", "",
+		"YAML configuration file, overridden by EVENTLOG_* environment "+
+			"variables and flags",
+	)
 	flag.Parse()
 
-	lApp := log.New(os.Stdout, "APP:", log.LstdFlags)
-	lDB := log.New(os.Stdout, "DB:", log.LstdFlags)
+	cfg, err := config.Load(fConfig)
+	if err == nil {
+		err = cfg.Apply(flag.CommandLine)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	l, err := cli.NewLogger(os.Stdout, fLogFormat, slog.LevelDebug)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	lApp := l.With(slog.String("component", "app"))
+	lDB := l.With(slog.String("component", "db"))
 	if !fEnableDBLog {
-		lDB.SetOutput(io.Discard)
+		lDB = slog.New(slog.NewTextHandler(io.Discard, nil))
 	}
 
-	db, err := database.Open(fDBDir, lDB)
+	db, err := database.Open(
+		fDBDir, lDB,
+		database.WithStrictConsistencyChecks(fDBStrict),
+		database.WithGCInterval(fGCInterval),
+	)
 	if err != nil {
-		lApp.Fatalf("opening database: %s", err)
+		lApp.Error("opening database", slog.Any("error", err))
+		os.Exit(1)
 	}
 	defer db.Close()
+	if fWarmUp {
+		go func() {
+			ctx, cancel := context.WithTimeout(
+				context.Background(), time.Minute,
+			)
+			defer cancel()
+			if err := db.WarmUp(ctx); err != nil {
+				lApp.Warn(
+					"database warm-up incomplete", slog.Any("error", err),
+				)
+			}
+		}()
+	}
+
+	var met *metrics.Metrics
+	if fMetricsAddr != "" {
+		met = metrics.New("consumer")
+		if err := met.Register(prometheus.DefaultRegisterer); err != nil {
+			lApp.Error("registering metrics", slog.Any("error", err))
+			os.Exit(1)
+		}
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			err := http.ListenAndServe(fMetricsAddr, nil)
+			lApp.Error("serving metrics", slog.Any("error", err))
+		}()
+	}
 
 	httpc := client.NewHTTP(
 		fHost,
@@ -52,114 +184,1177 @@ func main() {
 	httpc.SetRetryInterval(time.Second)
 	ec := client.New(httpc)
 
-	c := &Consumer{
-		db:  db,
-		c:   ec,
-		log: lApp,
+	labelPolicy := LabelPolicyIgnore
+	if fRejectUnknown {
+		labelPolicy = LabelPolicyReject
 	}
+	c := NewConsumer(
+		db, ec, lApp,
+		WithSyncTimeout(fSyncTimeout),
+		WithUnknownLabelPolicy(labelPolicy),
+		WithScanBatchSize(fBatchSize),
+		WithMetrics(met),
+		WithErrorHandler(func(err error) {
+			lApp.Error("running consumer", slog.Any("error", err))
+			db.Close()
+			os.Exit(1)
+		}),
+	)
+	// ctx is canceled on SIGINT, SIGTERM or when the CLI exits
+	ctx, stop := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+	defer stop()
+
+	// wg awaits the consumer and the expirer before the database is closed
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
-		if err := c.Run(context.Background()); err != nil {
+		defer wg.Done()
+		if err := runner.RunWithRecovery(
+			ctx, lApp, c.Run,
+			func(r interface{}) {
+				lApp.Error("recovered from panic", slog.Any("panic", r))
+			},
+		); err != nil {
 			if !errors.Is(err, context.Canceled) &&
 				!errors.Is(err, context.DeadlineExceeded) {
-				lApp.Fatalf("running consumer: %s", err)
+				lApp.Error("running consumer", slog.Any("error", err))
+				db.Close()
+				os.Exit(1)
 			}
 		}
 	}()
 
-	fmt.Println(`commands: `)
-	fmt.Println(`  print: prints the current state of the world`)
-	fmt.Println(`  exit:  exits the program`)
-	fmt.Println("---------------------")
-	if err := cli.ScanLines(func(ln string) error {
-		switch ln {
-		case "exit":
-			return cli.ErrAbortScan
-		case "print":
-			return c.ScanDB(func(v client.Version) (resume bool) {
-				if v == "" {
-					c.log.Printf("projection version: log empty")
-				} else {
-					c.log.Printf("projection version: %s", v)
-				}
-				return true
-			}, func(object string, num int64) (resume bool) {
-				fmt.Printf(" %s: %d\n", object, num)
-				return true
-			})
-		default:
-			fmt.Printf("  unknown command: %q\n", ln)
+	go func() {
+		defer wg.Done()
+		err := c.RunExpirer(ctx, time.Minute)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			lApp.Error("running expirer", slog.Any("error", err))
 		}
-		return nil
-	}); err != nil {
-		c.log.Printf("ERR CLI: %s", err)
+	}()
+
+	var m cli.MultiCommand
+	registerCommands(&m, c, fPageSize)
+
+	onInput := func(ln string) error {
+		err := m.Dispatch(ln)
+		switch {
+		case errors.Is(err, cli.ErrUnknownCommand),
+			errors.Is(err, cli.ErrEmptyInput),
+			errors.Is(err, cli.ErrUnterminatedQuote):
+			fmt.Printf("  %s\n", err)
+			return nil
+		}
+		return err
+	}
+	cliDone := make(chan error, 1)
+	go func() {
+		if fScript != "" {
+			cliDone <- cli.ScanLinesFromFile(fScript, onInput)
+			return
+		}
+		if fCLITimeout > 0 {
+			err := cli.ScanLinesWithTimeout(os.Stdin, fCLITimeout, onInput)
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			cliDone <- err
+			return
+		}
+		fmt.Println(`commands: `)
+		fmt.Print(m.Help())
+		fmt.Println("---------------------")
+		cliDone <- cli.ScanLinesWithHistory(fHistFile, m.Names(), onInput)
+	}()
+	select {
+	case err := <-cliDone:
+		if err != nil {
+			c.log().Error("CLI", slog.Any("error", err))
+		}
+	case <-ctx.Done():
+		c.log().Info("received shutdown signal")
+	}
+
+	stop()
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(fShutdownTimeout):
+		c.log().Error(
+			"consumer didn't stop in time",
+			slog.Duration("timeout", fShutdownTimeout),
+		)
+		os.Exit(1)
 	}
 }
 
 // Consumer is an event log consumer and an aggregate.
 // It stores its projection of the current state of the world in a database.
 type Consumer struct {
-	db  *database.DB
-	c   *client.Client
-	log *log.Logger
+	// applied and skipped are the numbers of applied and skipped events
+	// and must be accessed atomically, they're placed first to guarantee
+	// 64-bit alignment.
+	applied int64
+	skipped int64
+
+	// syncCount, errorCount, lastSyncAt (unix nanoseconds) and lastSyncDur
+	// are synchronization statistics and must be accessed atomically.
+	syncCount   uint64
+	errorCount  uint64
+	lastSyncAt  int64
+	lastSyncDur int64
+
+	// applyDelay is the delay in nanoseconds before each event is applied
+	// and must be accessed atomically. It's only set in testutil builds.
+	applyDelay int64
+
+	db            *database.DB
+	c             *client.Client
+	syncTimeout   time.Duration
+	pollInterval  time.Duration
+	hooks         Hooks
+	labelPolicy   LabelPolicy
+	eventFilter   func(event.EventType) bool
+	scanBatchSize int
+	metrics       *metrics.Metrics
+	onError       func(error)
+
+	skippedLabelsLock sync.Mutex
+	skippedLabels     map[string]struct{}
+
+	// versionChanged is closed and replaced whenever a transaction
+	// that changed the projection version is committed.
+	versionLock    sync.Mutex
+	versionChanged chan struct{}
+
+	logger atomic.Pointer[slog.Logger]
+	level  slog.LevelVar
+
+	// status is replaced by updateStatus and nil until the first update.
+	status atomic.Pointer[ConsumerStatus]
+
+	// labelAllowlist is set by FilterLabels and nil if all labels
+	// are allowed.
+	labelAllowlist atomic.Pointer[map[event.EventType]struct{}]
+}
+
+// LabelPolicy defines how events with unknown labels are handled.
+type LabelPolicy int
+
+const (
+	// LabelPolicyIgnore skips events with unknown labels, which are
+	// usually emitted by newer producers, counting them as skipped.
+	LabelPolicyIgnore LabelPolicy = iota
+
+	// LabelPolicyReject fails the synchronization on unknown labels,
+	// which is a strict mode for consumers that must not miss any event.
+	LabelPolicyReject
+)
+
+// Hooks are functions executed around the application of each event.
+// Either of the functions may be nil.
+type Hooks struct {
+	// PreApply is called before e is applied. If it returns an error
+	// the event is filtered out and skipped without an error.
+	PreApply func(tx *database.Tx, e client.Event) error
+
+	// PostApply is called after e is applied with the resulting quantity
+	// of the affected object. If it returns an error the transaction
+	// is discarded.
+	PostApply func(tx *database.Tx, e client.Event, quantity int64) error
+}
+
+// Option configures a Consumer.
+type Option func(*Consumer)
+
+// WithSyncTimeout makes all synchronizations performed by Run
+// time out after d. A zero duration disables the timeout.
+func WithSyncTimeout(d time.Duration) Option {
+	return func(c *Consumer) { c.syncTimeout = d }
+}
+
+// WithPollInterval sets the interval at which WaitForObject
+// polls the database. The default interval is 500 milliseconds.
+func WithPollInterval(d time.Duration) Option {
+	return func(c *Consumer) { c.pollInterval = d }
+}
+
+// WithHooks sets the hooks executed around the application of each event.
+func WithHooks(h Hooks) Option {
+	return func(c *Consumer) { c.hooks = h }
+}
+
+// WithUnknownLabelPolicy sets how events with unknown labels are handled.
+// The default policy is LabelPolicyIgnore.
+func WithUnknownLabelPolicy(p LabelPolicy) Option {
+	return func(c *Consumer) { c.labelPolicy = p }
+}
+
+// WithEventFilter makes all synchronizations skip events for which
+// fn returns false, advancing the projection version past them.
+func WithEventFilter(fn func(event.EventType) bool) Option {
+	return func(c *Consumer) { c.eventFilter = fn }
 }
 
+// WithScanBatchSize sets the number of scanned events buffered
+// before they're applied using BulkApply. The default size is 100.
+// Sizes below 1 are treated as 1.
+func WithScanBatchSize(n int) Option {
+	if n < 1 {
+		n = 1
+	}
+	return func(c *Consumer) { c.scanBatchSize = n }
+}
+
+// WithMetrics sets the metrics updated by the consumer.
+// Metrics aren't collected by default.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(c *Consumer) { c.metrics = m }
+}
+
+// WithErrorHandler makes Run call fn with errors synchronizing
+// on updates. By default such errors are logged and stop Run,
+// which then returns the error.
+func WithErrorHandler(fn func(error)) Option {
+	return func(c *Consumer) { c.onError = fn }
+}
+
+// NewConsumer creates a new consumer.
+func NewConsumer(
+	db *database.DB,
+	c *client.Client,
+	l *slog.Logger,
+	opts ...Option,
+) *Consumer {
+	s := &Consumer{
+		db:            db,
+		c:             c,
+		pollInterval:  500 * time.Millisecond,
+		eventFilter:   func(event.EventType) bool { return true },
+		scanBatchSize: 100,
+
+		skippedLabels:  map[string]struct{}{},
+		versionChanged: make(chan struct{}),
+	}
+	s.level.Set(slog.LevelDebug)
+	s.logger.Store(slog.New(&levelHandler{h: l.Handler(), level: &s.level}))
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// SetLogger replaces the logger of the consumer.
+// A nil logger discards all records. The level set by SetLogLevel
+// applies to the new logger as well.
+// It's safe to call while the consumer is running.
+func (c *Consumer) SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	c.logger.Store(slog.New(&levelHandler{h: l.Handler(), level: &c.level}))
+}
+
+// SetLogLevel sets the minimum level of the records written by the logger
+// of the consumer, whether passed to NewConsumer or set by SetLogger.
+// The default level is slog.LevelDebug.
+// It's safe to call while the consumer is running.
+func (c *Consumer) SetLogLevel(level slog.Level) {
+	c.level.Set(level)
+}
+
+// log returns the current logger of the consumer.
+func (c *Consumer) log() *slog.Logger { return c.logger.Load() }
+
 // Run synchronizes the database and begins listening for new events
 // as long as ctx is not canceled.
 func (c *Consumer) Run(ctx context.Context) (err error) {
-	if err := c.Sync(context.Background()); err != nil {
+	if err := c.sync(context.Background()); err != nil {
 		return fmt.Errorf("synchronizing: %w", err)
 	}
 
-	c.log.Printf("listening for updates")
-	return c.c.Listen(ctx, func(v client.Version) {
-		c.log.Printf("update received, log version: %s", string(v))
-		if err = c.Sync(ctx); err != nil {
-			err = fmt.Errorf("synchronizing: %w", err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var errSync error
+	onError := c.onError
+	if onError == nil {
+		onError = func(err error) {
+			c.log().Error("synchronizing on update", slog.Any("error", err))
+			errSync = err
+			cancel()
+		}
+	}
+
+	c.log().Info("listening for updates")
+	err = c.c.Listen(ctx, func(v client.Version) {
+		c.log().Info("update received", slog.String("version", v))
+		c.updateLag(v)
+		if err := c.sync(ctx); err != nil {
+			onError(fmt.Errorf("synchronizing: %w", err))
 			return
 		}
+		c.updateLag(v)
 	})
+	if errSync != nil {
+		return errSync
+	}
+	return err
 }
 
 // Sync synchronizes the database against the eventlog applying any
 // relevant event.
-func (c *Consumer) Sync(ctx context.Context) error {
-	c.log.Printf("synchronizing")
+func (c *Consumer) Sync(ctx context.Context) (err error) {
+	ctx, span := otel.Tracer().Start(ctx, "Consumer.Sync")
+	defer func() { otel.End(span, err) }()
 
-	return c.db.WithinTx(database.ReadWrite, func(tx *database.Tx) error {
+	c.log().Info("synchronizing")
+	start := time.Now()
+	c.updateStatus(func(s *ConsumerStatus) { s.IsSyncing = true })
+
+	err = c.FilteredSync(ctx, c.eventFilter)
+	v, errVersion := c.projectionVersion()
+	c.updateStatus(func(s *ConsumerStatus) {
+		s.IsSyncing = false
+		s.LastSyncAt = start
+		if errVersion == nil {
+			s.ProjectionVersion = v
+			if database.CompareVersions(v, s.LatestLogVersion) > 0 {
+				s.LatestLogVersion = v
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.String("version", v))
+	return errVersion
+}
+
+// ConsumerStatus is the synchronization status of a consumer.
+type ConsumerStatus struct {
+	ProjectionVersion client.Version
+
+	// LatestLogVersion is the latest event log version the consumer
+	// was notified about.
+	LatestLogVersion client.Version
+
+	// VersionsBehind is the difference between LatestLogVersion and
+	// ProjectionVersion. It's a lag indicator rather than a number of events
+	// since versions aren't necessarily consecutive. Versions of the
+	// file backend are byte offsets, for example.
+	VersionsBehind int64
+
+	LastSyncAt time.Time
+	IsSyncing  bool
+}
+
+// Status returns the current synchronization status of the consumer
+// without accessing the database. It's safe for concurrent use.
+func (c *Consumer) Status() ConsumerStatus {
+	if s := c.status.Load(); s != nil {
+		return *s
+	}
+	return ConsumerStatus{}
+}
+
+// updateStatus atomically replaces the status with a copy modified by fn
+// and recalculates VersionsBehind.
+func (c *Consumer) updateStatus(fn func(s *ConsumerStatus)) {
+	for {
+		old := c.status.Load()
+		var s ConsumerStatus
+		if old != nil {
+			s = *old
+		}
+		fn(&s)
+		s.VersionsBehind = versionsBehind(
+			s.LatestLogVersion, s.ProjectionVersion,
+		)
+		if c.status.CompareAndSwap(old, &s) {
+			return
+		}
+	}
+}
+
+// versionsBehind returns the difference between the hexadecimal versions
+// latest and projected or 0 if either can't be parsed.
+func versionsBehind(latest, projected client.Version) int64 {
+	parse := func(v client.Version) (uint64, error) {
+		if v == "" {
+			return 0, nil
+		}
+		return strconv.ParseUint(v, 16, 64)
+	}
+	l, err := parse(latest)
+	if err != nil {
+		return 0
+	}
+	p, err := parse(projected)
+	if err != nil || p >= l {
+		return 0
+	}
+	return int64(l - p)
+}
+
+// FilteredSync is similar to Sync but only applies events for which
+// labelFilter returns true, skipping all others while still advancing
+// the projection version past them.
+func (c *Consumer) FilteredSync(
+	ctx context.Context,
+	labelFilter func(event.EventType) bool,
+) error {
+	start := time.Now()
+	err := c.db.WithinTxContext(ctx, database.ReadWrite, func(
+		tx *database.Tx,
+	) error {
+		return c.syncTx(ctx, tx, "", labelFilter, true)
+	})
+	atomic.AddUint64(&c.syncCount, 1)
+	atomic.StoreInt64(&c.lastSyncAt, start.UnixNano())
+	d := time.Since(start)
+	atomic.StoreInt64(&c.lastSyncDur, int64(d))
+	c.metrics.ObserveSync(d)
+	if err != nil {
+		atomic.AddUint64(&c.errorCount, 1)
+	}
+	return err
+}
+
+// CatchUpTo synchronizes the database against the eventlog applying
+// all events up to and including targetVersion, which is useful for
+// point-in-time recovery. ErrVersionTooOld is returned if targetVersion
+// precedes the current projection version since events can't be unapplied.
+func (c *Consumer) CatchUpTo(
+	ctx context.Context,
+	targetVersion client.Version,
+) error {
+	c.log().Info(
+		"catching up", slog.String("version", targetVersion),
+	)
+
+	return c.db.WithinTxContext(ctx, database.ReadWrite, func(
+		tx *database.Tx,
+	) error {
 		v, err := tx.GetProjectionVersion()
 		if err != nil {
 			return fmt.Errorf("reading projection version: %w", err)
 		}
+		switch database.CompareVersions(targetVersion, v) {
+		case -1:
+			return ErrVersionTooOld
+		case 0:
+			return nil
+		}
+		if err := c.syncTx(
+			ctx, tx, targetVersion, c.eventFilter, true,
+		); err != nil {
+			return err
+		}
+		if v, err = tx.GetProjectionVersion(); err != nil {
+			return fmt.Errorf("reading projection version: %w", err)
+		}
+		if v != targetVersion {
+			return ErrVersionNotReached
+		}
+		return nil
+	})
+}
 
-		sv := v
-		if sv == "" {
-			if sv, err = c.c.VersionInitial(ctx); err != nil {
+var ErrVersionTooOld = errors.New("version precedes projection version")
+var ErrVersionNotReached = errors.New("version not reached")
+
+// SyncAndWait synchronizes the database and, if no new events were applied,
+// listens for new events and synchronizes once more as soon as the log
+// changes. ErrNoNewEvents is returned if the projection version remains
+// unchanged after the given timeout.
+func (c *Consumer) SyncAndWait(
+	ctx context.Context,
+	timeout time.Duration,
+) (finalVersion client.Version, err error) {
+	before, err := c.projectionVersion()
+	if err != nil {
+		return "", err
+	}
+	if err := c.Sync(ctx); err != nil {
+		return "", err
+	}
+	if finalVersion, err = c.projectionVersion(); err != nil {
+		return "", err
+	}
+	if finalVersion != before {
+		return finalVersion, nil
+	}
+
+	ctxListen, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := c.c.Listen(ctxListen, func(client.Version) {
+		cancel()
+	}); err != nil && !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded) {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// Synchronize even if the timeout was reached since new events
+	// could have been appended before listening began
+	if err := c.Sync(ctx); err != nil {
+		return "", err
+	}
+	if finalVersion, err = c.projectionVersion(); err != nil {
+		return "", err
+	}
+	if finalVersion == before {
+		return finalVersion, ErrNoNewEvents
+	}
+	return finalVersion, nil
+}
+
+var ErrNoNewEvents = errors.New("no new events")
+
+// projectionVersion reads the current projection version.
+func (c *Consumer) projectionVersion() (v client.Version, err error) {
+	err = c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		v, err = tx.GetProjectionVersion()
+		return err
+	})
+	return
+}
+
+// updateLag updates the status and the projection lag metric
+// given the latest version.
+func (c *Consumer) updateLag(latest client.Version) {
+	c.updateStatus(func(s *ConsumerStatus) {
+		if database.CompareVersions(latest, s.LatestLogVersion) > 0 {
+			s.LatestLogVersion = latest
+		}
+	})
+	if c.metrics == nil {
+		return
+	}
+	v, err := c.projectionVersion()
+	if err != nil {
+		c.log().Error("reading projection version", slog.Any("error", err))
+		return
+	}
+	c.metrics.SetLag(latest, v)
+}
+
+// syncTx synchronizes the database within the given transaction
+// and stops after applying targetVersion unless targetVersion is empty.
+// Events for which filter returns false are skipped.
+// No audit entries are recorded if audit is false.
+func (c *Consumer) syncTx(
+	ctx context.Context,
+	tx *database.Tx,
+	targetVersion client.Version,
+	filter func(event.EventType) bool,
+	audit bool,
+) error {
+	v, err := tx.GetVersionOrZero()
+	if err != nil {
+		return fmt.Errorf("reading projection version: %w", err)
+	}
+
+	sv := v
+	if sv == "" {
+		if sv, err = c.c.VersionInitial(ctx); err != nil {
+			return err
+		}
+		c.log().Info("starting at initial version")
+	} else {
+		c.log().Info("current projection version", slog.String("version", v))
+	}
+
+	if sv == "0" {
+		// Log is empty
+		c.log().Info("event log is empty")
+		return nil
+	}
+
+	batch := make([]client.Event, 0, c.scanBatchSize)
+	flush := func() error {
+		err := c.bulkApply(tx, batch, filter, audit)
+		batch = batch[:0]
+		return err
+	}
+	err = c.c.Scan(ctx, sv, false, func(e client.Event) error {
+		c.log().Debug(
+			"scanning",
+			slog.String("version", e.Version),
+			slog.String("label", string(e.Label)),
+			slog.String("payload", string(e.PayloadJSON)),
+		)
+		if v == e.Version {
+			// Ignore the current version
+			c.log().Debug("ignoring", slog.String("version", e.Version))
+			return nil
+		}
+		batch = append(batch, e)
+		if e.Version == targetVersion {
+			if err := flush(); err != nil {
 				return err
 			}
-			c.log.Printf("starting at initial version")
-		} else {
-			c.log.Printf("current projection version: %s", v)
+			return database.ErrAbortScan
+		}
+		if len(batch) >= c.scanBatchSize {
+			return flush()
 		}
+		return nil
+	})
+	if errors.Is(err, database.ErrAbortScan) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return flush()
+}
 
-		if sv == "0" {
-			// Log is empty
-			c.log.Printf("event log is empty")
-			return nil
+// ProcessEvent applies a single event obtained from outside the event log
+// scan within a new transaction. ErrVersionAlreadyApplied is returned
+// if the version of e doesn't succeed the current projection version.
+func (c *Consumer) ProcessEvent(ctx context.Context, e client.Event) error {
+	return c.db.WithinTxContext(ctx, database.ReadWrite, func(
+		tx *database.Tx,
+	) error {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+		v, err := tx.GetProjectionVersion()
+		if err != nil {
+			return fmt.Errorf("reading projection version: %w", err)
+		}
+		if database.CompareVersions(e.Version, v) <= 0 {
+			return ErrVersionAlreadyApplied
+		}
+		return c.BulkApply(tx, []client.Event{e}, c.eventFilter)
+	})
+}
+
+var ErrVersionAlreadyApplied = errors.New("version already applied")
 
-		return c.c.Scan(ctx, sv, false, func(e client.Event) error {
-			c.log.Printf(
-				"scanning (version: %s; label: %q; payload: %s)",
-				e.Version, string(e.Label), string(e.PayloadJSON),
+// BulkApply applies events in order within the given transaction
+// skipping events for which filter returns false and events with labels
+// not allowed by FilterLabels. An audit entry is recorded for each
+// applied event.
+func (c *Consumer) BulkApply(
+	tx *database.Tx,
+	events []client.Event,
+	filter func(event.EventType) bool,
+) error {
+	return c.bulkApply(tx, events, filter, true)
+}
+
+// bulkApply is BulkApply but records audit entries only if audit is true.
+func (c *Consumer) bulkApply(
+	tx *database.Tx,
+	events []client.Event,
+	filter func(event.EventType) bool,
+	audit bool,
+) error {
+	for _, e := range events {
+		if !filter(event.EventType(e.Label)) || !c.isAllowed(e.Label) {
+			c.log().Debug(
+				"skipping filtered event", slog.String("version", e.Version),
 			)
-			if v == e.Version {
-				// Ignore the current version
-				c.log.Printf("ignoring %s / %s", v, e.Version)
-				return nil
+			if err := c.setProjectionVersion(tx, e.Version); err != nil {
+				return err
 			}
-			return c.apply(tx, e)
-		})
+			continue
+		}
+		if err := c.applyWithHooks(tx, e, audit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FilterLabels makes all synchronizations skip events with labels other
+// than labels, advancing the projection version past them without
+// modifying any objects. Calling it without labels disables the
+// filter, which is the default. It's safe to call while the consumer
+// is running.
+func (c *Consumer) FilterLabels(labels ...string) {
+	if len(labels) < 1 {
+		c.labelAllowlist.Store(nil)
+		return
+	}
+	allowed := make(map[event.EventType]struct{}, len(labels))
+	for _, l := range labels {
+		allowed[event.EventType(l)] = struct{}{}
+	}
+	c.labelAllowlist.Store(&allowed)
+}
+
+// isAllowed returns false if label isn't allowed by FilterLabels.
+func (c *Consumer) isAllowed(label []byte) bool {
+	allowed := c.labelAllowlist.Load()
+	if allowed == nil {
+		return true
+	}
+	_, ok := (*allowed)[event.EventType(label)]
+	return ok
+}
+
+// SyncWithTimeout calls Sync canceling it if it doesn't complete within d
+// in which case context.DeadlineExceeded is returned and the transaction
+// is discarded, leaving the stored projection version untouched.
+func (c *Consumer) SyncWithTimeout(
+	ctx context.Context,
+	d time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	return c.Sync(ctx)
+}
+
+// sync calls either Sync or SyncWithTimeout
+// depending on whether a sync timeout is configured.
+// Synchronization is skipped while the database is sealed.
+func (c *Consumer) sync(ctx context.Context) (err error) {
+	if c.syncTimeout > 0 {
+		err = c.SyncWithTimeout(ctx, c.syncTimeout)
+	} else {
+		err = c.Sync(ctx)
+	}
+	if errors.Is(err, database.ErrDatabaseSealed) {
+		c.log().Info("database sealed, skipping synchronization")
+		return nil
+	}
+	return err
+}
+
+// WaitForObject blocks until the stored quantity of object
+// reaches minQuantity or ctx is canceled.
+func (c *Consumer) WaitForObject(
+	ctx context.Context,
+	object string,
+	minQuantity int64,
+) error {
+	// TODO: replace with Subscribe-based implementation
+	t := time.NewTicker(c.pollInterval)
+	defer t.Stop()
+	for {
+		q, err := c.Quantity(object)
+		if err != nil {
+			return err
+		}
+		if q >= minQuantity {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Quantity returns the stored quantity of object.
+func (c *Consumer) Quantity(object string) (quantity int64, err error) {
+	err = c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		quantity, err = tx.GetQuantity(object)
+		return err
+	})
+	return
+}
+
+// VersionAt returns the version at which object was last modified.
+// An empty version is returned if object was stored without a version.
+// ErrObjectNotFound is returned if object doesn't exist.
+func (c *Consumer) VersionAt(
+	ctx context.Context,
+	object string,
+) (version client.Version, err error) {
+	err = c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		version, err = projection.VersionAt(ctx, tx, object)
+		return err
+	})
+	return
+}
+
+var ErrObjectNotFound = projection.ErrObjectNotFound
+
+// Audit returns at most limit of the most recent operations applied
+// to the projection starting with the most recent one.
+func (c *Consumer) Audit(limit int) (entries []database.AuditEntry, err error) {
+	err = c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		entries, err = projection.Audit(tx, limit)
+		return err
+	})
+	return
+}
+
+// WaitForVersion blocks until the projection version is equal to
+// or greater than target or ctx is canceled.
+func (c *Consumer) WaitForVersion(
+	ctx context.Context,
+	target client.Version,
+) error {
+	for {
+		// Acquire the channel before reading the version
+		// to not miss any change in between.
+		c.versionLock.Lock()
+		changed := c.versionChanged
+		c.versionLock.Unlock()
+
+		v, err := c.projectionVersion()
+		if err != nil {
+			return err
+		}
+		if database.CompareVersions(v, target) >= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// setProjectionVersion sets the projection version within tx
+// and notifies WaitForVersion once tx is committed.
+func (c *Consumer) setProjectionVersion(
+	tx *database.Tx,
+	v client.Version,
+) error {
+	if err := tx.SetProjectionVersion(v); err != nil {
+		return err
+	}
+	tx.OnCommit(c.notifyVersionChanged)
+	return nil
+}
+
+// notifyVersionChanged wakes up all goroutines blocked in WaitForVersion.
+func (c *Consumer) notifyVersionChanged() {
+	c.versionLock.Lock()
+	defer c.versionLock.Unlock()
+	close(c.versionChanged)
+	c.versionChanged = make(chan struct{})
+}
+
+// GetChangedObjects returns all objects modified after the given version.
+func (c *Consumer) GetChangedObjects(
+	ctx context.Context,
+	since client.Version,
+) (changes []database.ObjectChange, err error) {
+	err = c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		changes, err = tx.GetChangesSince(since)
+		return err
+	})
+	return
+}
+
+// ConsumerStats are consumer runtime statistics.
+type ConsumerStats struct {
+	EventsApplied    uint64
+	EventsSkipped    uint64
+	SyncCount        uint64
+	LastSyncAt       time.Time
+	LastSyncDuration time.Duration
+	CurrentVersion   client.Version
+	ObjectCount      int64
+	ErrorCount       uint64
+}
+
+// Stats returns the current statistics of the consumer.
+// CurrentVersion and ObjectCount are zero if they can't be read.
+func (c *Consumer) Stats() ConsumerStats {
+	s := ConsumerStats{
+		EventsApplied:    uint64(atomic.LoadInt64(&c.applied)),
+		EventsSkipped:    uint64(atomic.LoadInt64(&c.skipped)),
+		SyncCount:        atomic.LoadUint64(&c.syncCount),
+		LastSyncDuration: time.Duration(atomic.LoadInt64(&c.lastSyncDur)),
+		ErrorCount:       atomic.LoadUint64(&c.errorCount),
+	}
+	if t := atomic.LoadInt64(&c.lastSyncAt); t != 0 {
+		s.LastSyncAt = time.Unix(0, t)
+	}
+	s.CurrentVersion, _ = c.projectionVersion()
+	s.ObjectCount, _ = c.db.ObjectCount()
+	return s
+}
+
+// EstimatedObjectCount returns an approximate number of stored objects
+// (see database.DB.EstimateCount).
+func (c *Consumer) EstimatedObjectCount(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.db.EstimateCount("o_")
+}
+
+// Reset deletes the entire projection.
+func (c *Consumer) Reset() error {
+	c.log().Info("resetting projection")
+	return c.db.Reset()
+}
+
+// Rebuild clears the projection and replays all events from the beginning
+// of the log calling progressFn every 1000 processed events
+// or 500 milliseconds, whichever comes first.
+// progressFn is called one final time with the total number of events
+// processed after the rebuild is completed.
+// The rebuild is performed within a single transaction so the projection
+// is left untouched if it fails.
+func (c *Consumer) Rebuild(
+	ctx context.Context,
+	progressFn func(eventsProcessed int64),
+) error {
+	start := atomic.LoadInt64(&c.applied)
+	processed := func() int64 { return atomic.LoadInt64(&c.applied) - start }
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(50 * time.Millisecond)
+		defer t.Stop()
+		var last int64
+		lastAt := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+			if n := processed(); n-last >= 1000 ||
+				(n != last && time.Since(lastAt) >= 500*time.Millisecond) {
+				progressFn(n)
+				last, lastAt = n, time.Now()
+			}
+		}
+	}()
+
+	err := c.db.WithinTxContext(ctx, database.ReadWrite, func(
+		tx *database.Tx,
+	) error {
+		if err := tx.SetProjectionVersionBatch("", nil); err != nil {
+			return fmt.Errorf("clearing projection: %w", err)
+		}
+		return c.syncTx(ctx, tx, "", c.eventFilter, false)
 	})
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("synchronizing: %w", err)
+	}
+	progressFn(processed())
+	return nil
+}
+
+// Rollback resets the projection to its state at toVersion by clearing it
+// and replaying all events up to and including toVersion within a single
+// transaction. database.ErrRollbackVersionNotReached is returned
+// if toVersion isn't a version of the log.
+func (c *Consumer) Rollback(
+	ctx context.Context,
+	toVersion client.Version,
+) error {
+	c.log().Info("rolling back", slog.String("version", toVersion))
+	return c.db.Rollback(ctx, toVersion, func(tx *database.Tx) error {
+		return c.syncTx(ctx, tx, toVersion, c.eventFilter, false)
+	})
+}
+
+// ExportNDJSON writes the current projection to w as newline-delimited JSON,
+// one object per line, followed by a final metadata line.
+// Each line is flushed immediately if w implements Flush() error.
+func (c *Consumer) ExportNDJSON(ctx context.Context, w io.Writer) error {
+	type object struct {
+		Object   string `json:"object"`
+		Quantity int64  `json:"quantity"`
+	}
+	type meta struct {
+		Version    client.Version `json:"version"`
+		Count      int64          `json:"count"`
+		ExportedAt time.Time      `json:"exported_at"`
+	}
+
+	f, _ := w.(interface{ Flush() error })
+	enc := json.NewEncoder(w)
+	writeLine := func(v interface{}) error {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		if f != nil {
+			return f.Flush()
+		}
+		return nil
+	}
+
+	return c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		v, err := tx.GetProjectionVersion()
+		if err != nil {
+			return err
+		}
+		var count int64
+		if err := tx.ScanObjects(func(o string, q int64) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			count++
+			return writeLine(object{Object: o, Quantity: q})
+		}); err != nil {
+			return err
+		}
+		return writeLine(struct {
+			Meta meta `json:"_meta"`
+		}{meta{Version: v, Count: count, ExportedAt: time.Now()}})
+	})
+}
+
+// RunExpirer calls RunExpiry every interval until ctx is canceled.
+func (c *Consumer) RunExpirer(
+	ctx context.Context,
+	interval time.Duration,
+) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if err := c.RunExpiry(ctx); err != nil {
+				c.log().Error("running expiry", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// RunExpiry drains the quantities of all objects that have expired.
+// Expiry should only be run by a single consumer since every consumer
+// would otherwise drain the same expired objects.
+func (c *Consumer) RunExpiry(ctx context.Context) error {
+	type expired struct {
+		object    string
+		quantity  int64
+		expiresAt time.Time
+	}
+	var l []expired
+	if err := c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		return tx.ScanExpired(time.Now(), func(
+			object string, quantity int64, expiresAt time.Time,
+		) error {
+			l = append(l, expired{object, quantity, expiresAt})
+			return nil
+		})
+	}); err != nil {
+		return fmt.Errorf("scanning expired: %w", err)
+	}
+	for _, x := range l {
+		if err := c.Drain(ctx, x.object, x.quantity, x.expiresAt); err != nil {
+			return fmt.Errorf("draining %q: %w", x.object, err)
+		}
+	}
+	return nil
+}
+
+// Drain appends a "take" event draining up to quantity objects of the given
+// type whose expiry is scheduled at expiresAt. The quantity is limited
+// to the unreserved quantity at the projected version the event is appended
+// onto, which is checked by the event log. Applying the event deletes the
+// expiry entry, so expiries drained before aren't drained again when
+// the log is replayed. Nothing is appended if the entry no longer exists.
+func (c *Consumer) Drain(
+	ctx context.Context,
+	object string,
+	quantity int64,
+	expiresAt time.Time,
+) error {
+	var version client.Version
+	var available int64
+	var scheduled bool
+	read := func() error {
+		return c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+			var err error
+			if version, err = tx.GetProjectionVersion(); err != nil {
+				return err
+			}
+			if scheduled, err = tx.HasExpiry(object, expiresAt); err != nil {
+				return err
+			}
+			q, err := tx.GetQuantity(object)
+			if err != nil {
+				return err
+			}
+			r, err := tx.GetReserved(object)
+			if err != nil {
+				return err
+			}
+			available = q - r
+			return nil
+		})
+	}
+	if err := read(); err != nil {
+		return err
+	}
+
+	_, _, _, err := c.c.TryAppend(
+		ctx, version,
+		func() (client.EventData, error) {
+			if !scheduled {
+				return client.EventData{}, errExpiryDrained
+			}
+			// Some of the expiring objects may have been taken already.
+			// Drain nothing in this case so that the expiry entry
+			// is still deleted through the log.
+			n := min(quantity, max(available, 0))
+			c.log().Info(
+				"draining expired",
+				slog.String("object", object),
+				slog.Int64("quantity", n),
+			)
+			return event.Encode(event.Event{
+				Operation: "take",
+				Object:    object,
+				Quantity:  n,
+				ExpiresAt: &expiresAt,
+			})
+		},
+		func() (client.Version, error) {
+			if err := c.sync(ctx); err != nil {
+				return "", err
+			}
+			err := read()
+			return version, err
+		},
+	)
+	if errors.Is(err, errExpiryDrained) {
+		return nil
+	}
+	return err
+}
+
+// errExpiryDrained is returned internally by Drain if the expiry entry
+// was deleted by an event applied in the meantime.
+var errExpiryDrained = errors.New("expiry already drained")
+
+// ScanOption configures ScanDB.
+type ScanOption func(*scanOptions)
+
+type scanOptions struct {
+	objectPrefix string
+}
+
+// WithObjectPrefix makes ScanDB only scan objects whose name starts
+// with prefix, which is stripped from the names passed to onObject
+// (see database.Tx.ScanObjectsWithPrefix).
+func WithObjectPrefix(prefix string) ScanOption {
+	return func(o *scanOptions) { o.objectPrefix = prefix }
 }
 
 // ScanDB calls onVersion supplying the current version
@@ -169,7 +1364,12 @@ func (c *Consumer) Sync(ctx context.Context) error {
 func (c *Consumer) ScanDB(
 	onVersion func(client.Version) (resume bool),
 	onObject func(object string, quantity int64) (resume bool),
+	opts ...ScanOption,
 ) error {
+	var o scanOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 	return c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
 		v, err := tx.GetProjectionVersion()
 		if err != nil {
@@ -178,54 +1378,317 @@ func (c *Consumer) ScanDB(
 		if !onVersion(v) {
 			return nil
 		}
-		return tx.ScanObjects(func(object string, quantity int64) error {
-			if !onObject(object, quantity) {
-				return database.ErrAbortScan
-			}
+		return tx.ScanObjectsWithPrefix(
+			o.objectPrefix, func(object string, quantity int64) error {
+				if !onObject(object, quantity) {
+					return database.ErrAbortScan
+				}
+				return nil
+			},
+		)
+	})
+}
+
+// ScanDBPage is similar to ScanDB but scans at most limit objects starting
+// at object cursor. nextCursor is empty if there are no more objects.
+// See database.Tx.ScanObjectsFrom for details on cursor and limit.
+func (c *Consumer) ScanDBPage(
+	cursor string,
+	limit int,
+	onVersion func(client.Version) (resume bool),
+	onObject func(object string, quantity int64) (resume bool),
+) (nextCursor string, err error) {
+	err = c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		v, err := tx.GetProjectionVersion()
+		if err != nil {
+			return err
+		}
+		if !onVersion(v) {
 			return nil
-		})
+		}
+		nextCursor, err = tx.ScanObjectsFrom(
+			cursor, limit, func(object string, quantity int64) error {
+				if !onObject(object, quantity) {
+					return database.ErrAbortScan
+				}
+				return nil
+			},
+		)
+		return err
 	})
+	return
 }
 
-// apply applies e to the database within the given transaction.
-func (c *Consumer) apply(tx *database.Tx, e client.Event) (err error) {
+// ObjectQuantity is an object scanned by ScanDBForExport.
+// Error is set on the last value sent if the scan failed.
+type ObjectQuantity struct {
+	Object   string
+	Quantity int64
+	Error    error
+}
+
+// ScanDBForExport scans all objects in a background goroutine sending them
+// to the returned channel, which is closed once the scan is completed,
+// failed or ctx is canceled.
+func (c *Consumer) ScanDBForExport(
+	ctx context.Context,
+) (<-chan ObjectQuantity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ch := make(chan ObjectQuantity, 64)
+	go func() {
+		defer close(ch)
+		err := c.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+			return tx.ScanObjects(func(o string, q int64) error {
+				select {
+				case ch <- ObjectQuantity{Object: o, Quantity: q}:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		})
+		if err != nil && ctx.Err() == nil {
+			ch <- ObjectQuantity{Error: err}
+		}
+	}()
+	return ch, nil
+}
+
+// applyWithHooks applies e to the database within the given transaction
+// executing the hooks set by WithHooks around it.
+// An audit entry is recorded if audit is true.
+func (c *Consumer) applyWithHooks(
+	tx *database.Tx,
+	e client.Event,
+	audit bool,
+) error {
+	if c.labelPolicy == LabelPolicyIgnore &&
+		!event.IsKnownLabel(string(e.Label)) {
+		c.skipUnknown(e)
+		return c.setProjectionVersion(tx, e.Version)
+	}
+	if h := c.hooks.PreApply; h != nil {
+		if err := h(tx, e); err != nil {
+			c.log().Info(
+				"filtered event",
+				slog.String("version", e.Version), slog.Any("reason", err),
+			)
+			return c.setProjectionVersion(tx, e.Version)
+		}
+	}
+	quantity, err := c.apply(tx, e, audit)
+	if err != nil {
+		return err
+	}
+	if h := c.hooks.PostApply; h != nil {
+		if err := h(tx, e, quantity); err != nil {
+			return fmt.Errorf("post-apply hook: %w", err)
+		}
+	}
+	return nil
+}
+
+// apply applies e to the database within the given transaction
+// and returns the resulting quantity of the affected object.
+// Zero is returned for bulk events and the resulting quantity
+// of the destination is returned for transfer events.
+// No audit entry is recorded if audit is false.
+func (c *Consumer) apply(
+	tx *database.Tx,
+	e client.Event,
+	audit bool,
+) (newQuantity int64, err error) {
 	defer func() {
 		if err != nil {
 			return
 		}
-		if err = tx.SetProjectionVersion(e.Version); err != nil {
+		if err = c.setProjectionVersion(tx, e.Version); err != nil {
 			return
 		}
-		c.log.Printf("update projection version: %s", e.Version)
+		c.log().Debug(
+			"update projection version", slog.String("version", e.Version),
+		)
 	}()
 
+	if d := atomic.LoadInt64(&c.applyDelay); d > 0 {
+		time.Sleep(time.Duration(d))
+	}
+
+	atomic.AddInt64(&c.applied, 1)
+	c.metrics.AddApplied(1)
+
 	event, err := event.Decode(e)
 	if err != nil {
-		return fmt.Errorf("decoding event: %w", err)
+		return 0, fmt.Errorf("decoding event: %w", err)
 	}
 
-	previousQuantity, err := tx.GetQuantity(event.Object)
-	if err != nil {
-		return err
+	// The span is a child of the span the event was appended within
+	_, span := otel.Tracer().Start(
+		otel.ExtractTraceContext(event), "Consumer.apply",
+		trace.WithAttributes(
+			attribute.String("operation", event.Operation),
+			attribute.String("object", event.Object),
+			attribute.Int64("quantity", event.Quantity),
+			attribute.String("version", e.Version),
+		),
+	)
+	defer func() { otel.End(span, err) }()
+	if event.Operation == "checkpoint" {
+		c.log().Debug("checkpoint", slog.String("version", e.Version))
+		return 0, nil
+	}
+	if event.IdempotencyKey != "" {
+		dup, err := tx.RecordIdempotencyKey(
+			event.IdempotencyKey, e.Version, event.RecordedAt,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("recording idempotency key: %w", err)
+		}
+		if dup {
+			c.log().Debug(
+				"skipping duplicate",
+				slog.String("version", e.Version),
+				slog.String("idempotency_key", event.IdempotencyKey),
+			)
+			return 0, nil
+		}
+	}
+	if audit {
+		if err := tx.SetAuditEntry(database.AuditEntry{
+			Version:   e.Version,
+			Operation: event.Operation,
+			Object:    event.Object,
+			Quantity:  event.Quantity,
+			AppliedAt: time.Now(),
+		}); err != nil {
+			return 0, fmt.Errorf("recording audit entry: %w", err)
+		}
+	}
+
+	if event.Operation == "expire" {
+		previousQuantity, err := tx.GetQuantity(event.Object)
+		if err != nil {
+			return 0, err
+		}
+		c.log().Debug(
+			"scheduling expiry",
+			slog.String("object", event.Object),
+			slog.Int64("quantity", event.Quantity),
+			slog.Time("expires_at", *event.ExpiresAt),
+		)
+		return previousQuantity, tx.SetExpiry(
+			event.Object, event.Quantity, *event.ExpiresAt,
+		)
 	}
-	var newQuantity int64
-	switch string(e.Label) {
+
+	c.log().Debug(
+		"applying",
+		slog.String("version", e.Version),
+		slog.Time("recorded_at", event.RecordedAt),
+	)
+
+	switch event.Operation {
+	case "bulk-put", "bulk-take":
+		for _, o := range projection.SortedObjects(event.Items) {
+			delta := event.Items[o]
+			if event.Operation == "bulk-take" {
+				delta = -delta
+			}
+			if _, err := c.applyDelta(tx, e, o, delta); err != nil {
+				return 0, err
+			}
+		}
+		return 0, nil
+	case "transfer":
+		_, err := c.applyDelta(tx, e, event.Source, -event.Quantity)
+		if err != nil {
+			return 0, err
+		}
+		return c.applyDelta(tx, e, event.Destination, event.Quantity)
+	case "reserve":
+		return 0, projection.ApplyReserved(
+			c.log(), tx,
+			event.ReservationID, event.Object, event.Quantity,
+		)
+	case "release":
+		err := projection.ApplyReserved(
+			c.log(), tx,
+			event.ReservationID, event.Object, -event.Quantity,
+		)
+		if err != nil || !event.Take {
+			return 0, err
+		}
+		return c.applyDelta(tx, e, event.Object, -event.Quantity)
 	case "take":
-		newQuantity = previousQuantity - int64(event.Quantity)
-	case "put":
-		newQuantity = previousQuantity + int64(event.Quantity)
+		if event.ExpiresAt != nil {
+			// The take drains an expiry (see Drain)
+			err := tx.DeleteExpiry(event.Object, *event.ExpiresAt)
+			if err != nil {
+				return 0, err
+			}
+			if event.Quantity < 1 {
+				return tx.GetQuantity(event.Object)
+			}
+		}
+		return c.applyDelta(tx, e, event.Object, -event.Quantity)
+	case "set":
+		q, err := tx.GetQuantity(event.Object)
+		if err != nil {
+			return 0, err
+		}
+		return c.applyDelta(tx, e, event.Object, event.Quantity-q)
 	}
+	return c.applyDelta(tx, e, event.Object, event.Quantity)
+}
 
-	c.log.Printf("applying version: %s", e.Version)
+// applyDelta adds delta to the quantity of object
+// and returns the resulting quantity.
+func (c *Consumer) applyDelta(
+	tx *database.Tx,
+	e client.Event,
+	object string,
+	delta int64,
+) (newQuantity int64, err error) {
+	previousQuantity, err := tx.GetQuantity(object)
+	if err != nil {
+		return 0, err
+	}
+	if err := projection.RecoverEntry(
+		c.log(), tx, object, previousQuantity,
+	); err != nil {
+		return 0, fmt.Errorf("recovering entry: %w", err)
+	}
+	newQuantity = previousQuantity + delta
 
 	if newQuantity < 1 {
-		c.log.Printf("deleting object: %q", event.Object)
-		return tx.Delete(event.Object)
+		c.log().Debug("deleting object", slog.String("object", object))
+		return 0, tx.Delete(object)
 	}
 
-	c.log.Printf(
-		"%s object %s: %d -> %d",
-		e.Label, event.Object, previousQuantity, newQuantity,
+	c.log().Debug(
+		"updating object",
+		slog.String("label", string(e.Label)),
+		slog.String("object", object),
+		slog.Int64("from", previousQuantity),
+		slog.Int64("to", newQuantity),
+	)
+	return newQuantity, tx.SetWithVersion(object, newQuantity, e.Version)
+}
+
+// skipUnknown counts e as skipped and logs a warning
+// the first time a particular unknown label is encountered.
+func (c *Consumer) skipUnknown(e client.Event) {
+	atomic.AddInt64(&c.skipped, 1)
+	c.skippedLabelsLock.Lock()
+	defer c.skippedLabelsLock.Unlock()
+	if _, ok := c.skippedLabels[string(e.Label)]; ok {
+		return
+	}
+	c.skippedLabels[string(e.Label)] = struct{}{}
+	c.log().Warn(
+		"skipping events with unknown label",
+		slog.String("label", string(e.Label)),
 	)
-	return tx.Set(event.Object, newQuantity)
 }
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/romshark/eventlog-example/database"
+	"github.com/romshark/eventlog-example/event"
+
+	"github.com/romshark/eventlog/client"
+	"github.com/romshark/eventlog/eventlog"
+	"github.com/romshark/eventlog/eventlog/inmem"
+)
+
+// newTestConsumer returns a consumer of an in-memory event log
+// projecting into an in-memory database.
+func newTestConsumer(t *testing.T, opts ...Option) (*Consumer, *client.Client) {
+	t.Helper()
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db, err := database.Open("", l)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	c := client.New(client.NewInmem(eventlog.New(inmem.New(nil))))
+	return NewConsumer(db, c, l, opts...), c
+}
+
+// appendEvent appends e to the log and returns its version.
+func appendEvent(t *testing.T, c *client.Client, e event.Event) client.Version {
+	t.Helper()
+	d, err := event.Encode(e)
+	if err != nil {
+		t.Fatalf("encoding %#v: %v", e, err)
+	}
+	_, v, _, err := c.Append(context.Background(), d)
+	if err != nil {
+		t.Fatalf("appending %#v: %v", e, err)
+	}
+	return v
+}
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 10,
+	})
+	toVersion := appendEvent(t, c, event.Event{
+		Operation: "put", Object: "pear", Quantity: 5,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	want, err := s.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+
+	appendEvent(t, c, event.Event{
+		Operation: "take", Object: "apple", Quantity: 3,
+	})
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "kiwi", Quantity: 2,
+	})
+	appendEvent(t, c, event.Event{
+		Operation: "reserve", Object: "pear", Quantity: 1,
+		ReservationID: "r1",
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+
+	if err := s.Rollback(ctx, toVersion); err != nil {
+		t.Fatalf("rolling back: %v", err)
+	}
+	got, err := s.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+	if got.Hash != want.Hash {
+		t.Fatalf("expected %v at %s, got %v at %s",
+			want.Objects, want.Version, got.Objects, got.Version)
+	}
+	err = s.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		_, _, ok, err := tx.GetReservation("r1")
+		if err == nil && ok {
+			t.Errorf("reservation r1 survived the rollback")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("reading reservation: %v", err)
+	}
+
+	// Synchronizing afterwards re-applies the rolled back events
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	for object, want := range map[string]int64{
+		"apple": 7, "pear": 5, "kiwi": 2,
+	} {
+		if q, err := s.Quantity(object); err != nil {
+			t.Fatalf("reading %q: %v", object, err)
+		} else if q != want {
+			t.Errorf("expected %q to be %d, got %d", object, want, q)
+		}
+	}
+}
+
+func TestRollbackUnknownVersion(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 10,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	want, err := s.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+
+	err = s.Rollback(ctx, "ffffffffffff")
+	if !errors.Is(err, database.ErrRollbackVersionNotReached) {
+		t.Fatalf("expected ErrRollbackVersionNotReached, got %v", err)
+	}
+	got, err := s.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+	if got.Hash != want.Hash {
+		t.Fatalf("projection changed by a failed rollback: %v", got.Objects)
+	}
+}
+
+func TestStatusVersionsBehind(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 1,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if st := s.Status(); st.VersionsBehind != 0 {
+		t.Fatalf("expected to be caught up, got %#v", st)
+	}
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 1,
+	})
+	latest := appendEvent(t, c, event.Event{
+		Operation: "put", Object: "pear", Quantity: 1,
+	})
+	// Notify the consumer about the latest version as Run does
+	// without synchronizing
+	s.updateLag(latest)
+	st := s.Status()
+	if st.VersionsBehind < 1 {
+		t.Fatalf("expected to be behind, got %#v", st)
+	}
+	if st.LatestLogVersion != latest {
+		t.Fatalf("expected latest version %s, got %s",
+			latest, st.LatestLogVersion)
+	}
+
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if st := s.Status(); st.VersionsBehind != 0 {
+		t.Fatalf("expected to be caught up, got %#v", st)
+	}
+}
+
+func TestSetLoggerNil(t *testing.T) {
+	s, c := newTestConsumer(t)
+	s.SetLogger(nil)
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 1,
+	})
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+}
+
+func TestSetLogLevelAppliesToSetLogger(t *testing.T) {
+	s, c := newTestConsumer(t)
+	var logs bytes.Buffer
+	s.SetLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	})))
+	s.SetLogLevel(slog.LevelError)
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 1,
+	})
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("expected no records below error level, got %s", &logs)
+	}
+}
+
+func TestSetLoggerConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		levels := []slog.Level{slog.LevelDebug, slog.LevelWarn}
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.SetLogLevel(levels[i%len(levels)])
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		appendEvent(t, c, event.Event{
+			Operation: "put", Object: "apple", Quantity: 1,
+		})
+		if err := s.Sync(ctx); err != nil {
+			t.Errorf("syncing: %v", err)
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestRunErrorHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Applying fails once armed, after Run synchronized at least once
+	var armed atomic.Bool
+	errApply := errors.New("apply failed")
+	applied := make(chan struct{}, 64)
+	errs := make(chan error, 64)
+	s, c := newTestConsumer(t,
+		WithHooks(Hooks{PostApply: func(
+			tx *database.Tx, e client.Event, quantity int64,
+		) error {
+			if armed.Load() {
+				return errApply
+			}
+			applied <- struct{}{}
+			return nil
+		}}),
+		WithErrorHandler(func(err error) { errs <- err }),
+	)
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run(ctx) }()
+
+	// Keep appending until Run synchronizes
+	appendUntil := func(received func() bool) {
+		t.Helper()
+		timeout := time.After(time.Second)
+		for !received() {
+			appendEvent(t, c, event.Event{
+				Operation: "put", Object: "apple", Quantity: 1,
+			})
+			select {
+			case err := <-runErr:
+				t.Fatalf("Run returned early: %v", err)
+			case <-timeout:
+				t.Fatalf("timed out")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	appendUntil(func() bool {
+		select {
+		case <-applied:
+			return true
+		default:
+			return false
+		}
+	})
+	armed.Store(true)
+	var err error
+	appendUntil(func() bool {
+		select {
+		case err = <-errs:
+			return true
+		default:
+			return false
+		}
+	})
+	if !errors.Is(err, errApply) {
+		t.Fatalf("expected the apply error, got %v", err)
+	}
+
+	// Errors handled by the error handler don't stop Run
+	select {
+	case err := <-runErr:
+		t.Fatalf("Run returned after a handled error: %v", err)
+	default:
+	}
+	cancel()
+	if err := <-runErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 10,
+	})
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "pear", Quantity: 5,
+	})
+	appendEvent(t, c, event.Event{
+		Operation: "take", Object: "apple", Quantity: 3,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	var want bytes.Buffer
+	if err := s.db.ExportJSON(&want); err != nil {
+		t.Fatalf("exporting: %v", err)
+	}
+
+	// Corrupt the projection
+	if err := s.db.WithinTx(database.ReadWrite, func(tx *database.Tx) error {
+		if err := tx.Set("apple", 100); err != nil {
+			return err
+		}
+		return tx.Set("kiwi", 1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress []int64
+	if err := s.Rebuild(ctx, func(n int64) {
+		progress = append(progress, n)
+	}); err != nil {
+		t.Fatalf("rebuilding: %v", err)
+	}
+	if l := len(progress); l < 1 || progress[l-1] != 3 {
+		t.Fatalf("expected a final progress of 3 events, got %v", progress)
+	}
+	var got bytes.Buffer
+	if err := s.db.ExportJSON(&got); err != nil {
+		t.Fatalf("exporting: %v", err)
+	}
+	if got.String() != want.String() {
+		t.Fatalf("expected %s, got %s", want.String(), got.String())
+	}
+}
+
+func TestReplayRecordsNoAudit(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+
+	v1 := appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 10,
+	})
+	appendEvent(t, c, event.Event{
+		Operation: "take", Object: "apple", Quantity: 3,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	checkAudit := func(op string) {
+		t.Helper()
+		entries, err := s.Audit(100)
+		if err != nil {
+			t.Fatalf("reading audit after %s: %v", op, err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf(
+				"expected 2 audit entries after %s, got %d",
+				op, len(entries),
+			)
+		}
+	}
+	checkAudit("sync")
+
+	if err := s.Rebuild(ctx, func(int64) {}); err != nil {
+		t.Fatalf("rebuilding: %v", err)
+	}
+	checkAudit("rebuild")
+
+	if err := s.Rollback(ctx, v1); err != nil {
+		t.Fatalf("rolling back: %v", err)
+	}
+	checkAudit("rollback")
+}
+
+func TestWaitForVersion(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+
+	v1 := appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 1,
+	})
+	v2 := appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 1,
+	})
+
+	// Waiting times out while the projection is behind
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForVersion(tctx, v1); !errors.Is(
+		err, context.DeadlineExceeded,
+	) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- s.WaitForVersion(ctx, v2) }()
+	select {
+	case err := <-waited:
+		t.Fatalf("returned before synchronizing: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatalf("waiting: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("not unblocked by the synchronization")
+	}
+
+	// Versions already reached return immediately
+	if err := s.WaitForVersion(ctx, v1); err != nil {
+		t.Fatalf("waiting for a reached version: %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	errBroken := errors.New("broken")
+	s, c := newTestConsumer(t,
+		WithHooks(Hooks{PostApply: func(
+			tx *database.Tx, e client.Event, quantity int64,
+		) error {
+			if ev, err := event.Decode(e); err == nil && ev.Object == "broken" {
+				return errBroken
+			}
+			return nil
+		}}),
+	)
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 1,
+	})
+	v := appendEvent(t, c, event.Event{
+		Operation: "put", Object: "pear", Quantity: 1,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	_, v, _, err := c.Append(ctx, client.EventData{
+		Label: []byte("future"), PayloadJSON: []byte(`{"object":"apple"}`),
+	})
+	if err != nil {
+		t.Fatalf("appending: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Sync(ctx); err != nil {
+			t.Fatalf("syncing: %v", err)
+		}
+	}
+
+	st := s.Stats()
+	if st.SyncCount != 3 {
+		t.Errorf("expected 3 synchronizations, got %d", st.SyncCount)
+	}
+	if st.EventsApplied != 2 || st.EventsSkipped != 1 {
+		t.Errorf("expected 2 applied and 1 skipped events, got %d and %d",
+			st.EventsApplied, st.EventsSkipped)
+	}
+	if st.CurrentVersion != v {
+		t.Errorf("expected version %s, got %s", v, st.CurrentVersion)
+	}
+	if st.ObjectCount != 2 {
+		t.Errorf("expected 2 objects, got %d", st.ObjectCount)
+	}
+	if st.LastSyncAt.IsZero() || st.ErrorCount != 0 {
+		t.Errorf("unexpected statistics: %#v", st)
+	}
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "broken", Quantity: 1,
+	})
+	if err := s.Sync(ctx); !errors.Is(err, errBroken) {
+		t.Fatalf("expected the hook error, got %v", err)
+	}
+	if st := s.Stats(); st.SyncCount != 4 || st.ErrorCount != 1 {
+		t.Errorf("expected 4 synchronizations and 1 error, got %d and %d",
+			st.SyncCount, st.ErrorCount)
+	}
+}
+
+func TestUnknownLabelsSkipped(t *testing.T) {
+	ctx := context.Background()
+	unknown := client.EventData{
+		Label: []byte("future"), PayloadJSON: []byte(`{"object":"apple"}`),
+	}
+
+	var logs bytes.Buffer
+	s, c := newTestConsumer(t)
+	s.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 1,
+	})
+	var v client.Version
+	for i := 0; i < 2; i++ {
+		var err error
+		if _, v, _, err = c.Append(ctx, unknown); err != nil {
+			t.Fatalf("appending: %v", err)
+		}
+	}
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if pv, err := s.projectionVersion(); err != nil {
+		t.Fatalf("reading projection version: %v", err)
+	} else if pv != v {
+		t.Fatalf("expected version %s, got %s", v, pv)
+	}
+	if q, err := s.Quantity("apple"); err != nil {
+		t.Fatalf("reading quantity: %v", err)
+	} else if q != 1 {
+		t.Fatalf("expected 1, got %d", q)
+	}
+	if st := s.Stats(); st.EventsApplied != 1 || st.EventsSkipped != 2 {
+		t.Fatalf("expected 1 applied and 2 skipped events, got %d and %d",
+			st.EventsApplied, st.EventsSkipped)
+	}
+	const msg = "skipping events with unknown label"
+	if n := strings.Count(logs.String(), msg); n != 1 {
+		t.Fatalf("expected the label to be logged once, got %d", n)
+	}
+
+	// Rejecting unknown labels is opt-in
+	s, c = newTestConsumer(t, WithUnknownLabelPolicy(LabelPolicyReject))
+	if _, _, _, err := c.Append(ctx, unknown); err != nil {
+		t.Fatalf("appending: %v", err)
+	}
+	var errUnknown event.UnknownEventError
+	if err := s.Sync(ctx); !errors.As(err, &errUnknown) {
+		t.Fatalf("expected UnknownEventError, got %v", err)
+	}
+}
+
+func TestFilterLabels(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+	s.FilterLabels("put")
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 5,
+	})
+	v := appendEvent(t, c, event.Event{
+		Operation: "take", Object: "apple", Quantity: 2,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if q, err := s.Quantity("apple"); err != nil {
+		t.Fatalf("reading quantity: %v", err)
+	} else if q != 5 {
+		t.Fatalf("expected the take to be ignored, got %d", q)
+	}
+	if pv, err := s.projectionVersion(); err != nil {
+		t.Fatalf("reading projection version: %v", err)
+	} else if pv != v {
+		t.Fatalf("expected version %s, got %s", v, pv)
+	}
+
+	// Disabling the filter applies following events of all labels
+	s.FilterLabels()
+	appendEvent(t, c, event.Event{
+		Operation: "take", Object: "apple", Quantity: 1,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if q, err := s.Quantity("apple"); err != nil {
+		t.Fatalf("reading quantity: %v", err)
+	} else if q != 4 {
+		t.Fatalf("expected 4, got %d", q)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/romshark/eventlog-example/database"
+
+	"github.com/romshark/eventlog/client"
+)
+
+// ProjectionSnapshot is an immutable copy of the projection,
+// which can be serialized using encoding/json.
+type ProjectionSnapshot struct {
+	Version    client.Version   `json:"version"`
+	Objects    map[string]int64 `json:"objects"`
+	CapturedAt time.Time        `json:"captured_at"`
+
+	// Hash is the SHA-256 hash of the version and all objects
+	// in lexicographical order.
+	Hash [32]byte `json:"hash"`
+}
+
+// ObjectDiff describes the difference of an object between two snapshots.
+// A quantity of 0 means the object is absent from the respective snapshot.
+type ObjectDiff struct {
+	Object string
+	Before int64
+	After  int64
+}
+
+// Snapshot captures the current projection.
+func (c *Consumer) Snapshot(ctx context.Context) (*ProjectionSnapshot, error) {
+	s := &ProjectionSnapshot{Objects: map[string]int64{}}
+	var errCtx error
+	if err := c.ScanDB(func(v client.Version) bool {
+		s.Version = v
+		return true
+	}, func(object string, quantity int64) bool {
+		if errCtx = ctx.Err(); errCtx != nil {
+			return false
+		}
+		s.Objects[object] = quantity
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if errCtx != nil {
+		return nil, errCtx
+	}
+	s.CapturedAt = time.Now()
+	s.Hash = s.hash()
+	return s, nil
+}
+
+// RestoreFromSnapshot replaces the projection with the objects
+// and the version of s within a single transaction and then synchronizes
+// it applying all events newer than the snapshot. ErrSnapshotCorrupted
+// is returned if the hash of s doesn't match its contents.
+func (c *Consumer) RestoreFromSnapshot(
+	ctx context.Context,
+	s *ProjectionSnapshot,
+) error {
+	if s.hash() != s.Hash {
+		return ErrSnapshotCorrupted
+	}
+	if err := c.db.WithinTxContext(ctx, database.ReadWrite, func(
+		tx *database.Tx,
+	) error {
+		if err := tx.SetProjectionVersionBatch(
+			s.Version, s.Objects,
+		); err != nil {
+			return err
+		}
+		tx.OnCommit(c.notifyVersionChanged)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("restoring snapshot: %w", err)
+	}
+	return c.Sync(ctx)
+}
+
+var ErrSnapshotCorrupted = errors.New("snapshot corrupted")
+
+func (s *ProjectionSnapshot) hash() [32]byte {
+	objects := make([]string, 0, len(s.Objects))
+	for o := range s.Objects {
+		objects = append(objects, o)
+	}
+	sort.Strings(objects)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", s.Version)
+	for _, o := range objects {
+		fmt.Fprintf(h, "%q=%d\n", o, s.Objects[o])
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// Equals returns true if both snapshots captured the same projection.
+func (s *ProjectionSnapshot) Equals(other *ProjectionSnapshot) bool {
+	return s.Hash == other.Hash
+}
+
+// Diff returns the differences between s and other ordered by object name
+// where Before is the quantity in s and After the quantity in other.
+func (s *ProjectionSnapshot) Diff(other *ProjectionSnapshot) []ObjectDiff {
+	var diff []ObjectDiff
+	for o, q := range s.Objects {
+		if q != other.Objects[o] {
+			diff = append(diff, ObjectDiff{
+				Object: o, Before: q, After: other.Objects[o],
+			})
+		}
+	}
+	for o, q := range other.Objects {
+		if _, ok := s.Objects[o]; !ok {
+			diff = append(diff, ObjectDiff{Object: o, After: q})
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool {
+		return diff[i].Object < diff[j].Object
+	})
+	return diff
+}
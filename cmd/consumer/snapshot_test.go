@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/romshark/eventlog-example/database"
+	"github.com/romshark/eventlog-example/event"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 10,
+	})
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "pear", Quantity: 5,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	before, err := s.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+	if again, err := s.Snapshot(ctx); err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	} else if !before.Equals(again) || len(before.Diff(again)) > 0 {
+		t.Fatalf("expected unchanged snapshots to be equal")
+	}
+
+	appendEvent(t, c, event.Event{
+		Operation: "take", Object: "apple", Quantity: 3,
+	})
+	appendEvent(t, c, event.Event{
+		Operation: "take", Object: "pear", Quantity: 5,
+	})
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "kiwi", Quantity: 2,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	after, err := s.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+
+	if before.Equals(after) {
+		t.Fatalf("expected snapshots to differ")
+	}
+	if before.Objects["apple"] != 10 {
+		t.Fatalf("the earlier snapshot was modified: %v", before.Objects)
+	}
+	want := []ObjectDiff{
+		{Object: "apple", Before: 10, After: 7},
+		{Object: "kiwi", Before: 0, After: 2},
+		{Object: "pear", Before: 5, After: 0},
+	}
+	if d := before.Diff(after); !reflect.DeepEqual(d, want) {
+		t.Fatalf("expected %v, got %v", want, d)
+	}
+}
+
+func TestRestoreFromSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s, c := newTestConsumer(t)
+
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "apple", Quantity: 10,
+	})
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "pear", Quantity: 5,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	snapshot, err := s.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+
+	appendEvent(t, c, event.Event{
+		Operation: "take", Object: "apple", Quantity: 3,
+	})
+	appendEvent(t, c, event.Event{
+		Operation: "put", Object: "kiwi", Quantity: 2,
+	})
+	if err := s.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	want, err := s.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+
+	// Restore into an empty projection of the same log
+	db, err := database.Open("", s.log())
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	defer db.Close()
+	r := NewConsumer(db, c, s.log())
+	if err := r.RestoreFromSnapshot(ctx, snapshot); err != nil {
+		t.Fatalf("restoring: %v", err)
+	}
+	got, err := r.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+	if !got.Equals(want) {
+		t.Fatalf("expected the full replay %v, got %v", want, got)
+	}
+
+	snapshot.Objects["apple"] = 100
+	if err := r.RestoreFromSnapshot(ctx, snapshot); !errors.Is(
+		err, ErrSnapshotCorrupted,
+	) {
+		t.Fatalf("expected ErrSnapshotCorrupted, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/romshark/eventlog-example/cli"
+	"github.com/romshark/eventlog-example/database"
+)
+
+const usage = `usage:
+  dbutil backup -db-dir <dir> [-file <file>]
+  dbutil restore -db-dir <dir> [-file <file>]
+  dbutil gc -db-dir <dir> [-discard-ratio <ratio>]
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var fDBDir string
+	var fFile string
+	var fEnableDBLog bool
+	var fLogFormat string
+	var fDiscardRatio float64
+	f := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	f.StringVar(
+		&fDBDir, "db-dir", "", "database directory",
+	)
+	f.StringVar(
+		&fFile, "file", "", "backup file (empty=stdout for backup, "+
+			"stdin for restore)",
+	)
+	f.BoolVar(
+		&fEnableDBLog, "db-log", false, "enable database debug logging",
+	)
+	f.StringVar(
+		&fLogFormat, "log-format", "text", "log format (text or json)",
+	)
+	f.Float64Var(
+		&fDiscardRatio, "discard-ratio", 0.5,
+		"minimum discardable fraction of a value log file to rewrite it (gc)",
+	)
+	if err := f.Parse(os.Args[2:]); err != nil {
+		os.Exit(2)
+	}
+
+	// Log to stderr since backups may be written to stdout
+	l, err := cli.NewLogger(os.Stderr, fLogFormat, slog.LevelDebug)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	lApp := l.With(slog.String("component", "app"))
+	lDB := l.With(slog.String("component", "db"))
+	if !fEnableDBLog {
+		lDB = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if fDBDir == "" {
+		lApp.Error("missing database directory")
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "backup":
+		err = backup(fDBDir, fFile, lDB)
+	case "restore":
+		err = restore(fDBDir, fFile, lDB)
+	case "gc":
+		err = gc(fDBDir, fDiscardRatio, lApp, lDB)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		lApp.Error(os.Args[1], slog.Any("error", err))
+		os.Exit(1)
+	}
+}
+
+// backup writes a backup of the database in dir to file
+// or stdout if file is empty.
+func backup(dir, file string, l *slog.Logger) error {
+	db, err := database.NewReadOnlyDB(dir, l)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	if file == "" {
+		return db.Backup(os.Stdout)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := db.Backup(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// restore restores the backup read from file or stdin if file is empty
+// into the database in dir.
+func restore(dir, file string, l *slog.Logger) error {
+	db, err := database.Open(dir, l)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	if file == "" {
+		return db.Restore(os.Stdin)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return db.Restore(f)
+}
+
+// gc runs value log garbage collection on the database in dir
+// until no more value log files can be rewritten.
+func gc(dir string, discardRatio float64, lApp, lDB *slog.Logger) error {
+	db, err := database.Open(dir, lDB)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	for rewritten := 0; ; rewritten++ {
+		err := db.TriggerGC(discardRatio)
+		if errors.Is(err, database.ErrNoGCNeeded) {
+			lApp.Info(
+				"value log GC done", slog.Int("files_rewritten", rewritten),
+			)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/romshark/eventlog-example/cli"
+	"github.com/romshark/eventlog-example/database"
+)
+
+// registerCommands registers all CLI commands of the producer.
+func registerCommands(m *cli.MultiCommand, p *Producer) {
+	registerPut(m, p)
+	registerTake(m, p)
+	registerSet(m, p)
+	registerAdjust(m, p)
+	registerTransfer(m, p)
+	registerCheckpoint(m, p)
+	registerReplay(m, p)
+	registerCap(m, p)
+	registerStats(m, p)
+	registerAudit(m, p)
+	registerDBStats(m, p.db)
+	registerExit(m)
+}
+
+func registerPut(m *cli.MultiCommand, p *Producer) {
+	m.Describe("put", "<num> <object>", "puts n objects")
+	m.Register("put", func(args []string) error {
+		obj, quant, err := parseQuantityArgs("put", args)
+		if err != nil {
+			p.log.Error("parsing input", slog.Any("error", err))
+			return nil
+		}
+		return p.Put(context.Background(), obj, quant)
+	})
+}
+
+func registerTake(m *cli.MultiCommand, p *Producer) {
+	m.Describe("take", "<num> <object>", "takes n objects")
+	m.Register("take", func(args []string) error {
+		obj, quant, err := parseQuantityArgs("take", args)
+		if err != nil {
+			p.log.Error("parsing input", slog.Any("error", err))
+			return nil
+		}
+		if err := p.Take(context.Background(), obj, quant); err != nil {
+			if errors.Is(err, ErrInsuffQuant) {
+				p.log.Error(
+					"can't take, insufficient quantity",
+					slog.String("object", obj), slog.Int64("quantity", quant),
+				)
+				return nil
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func registerSet(m *cli.MultiCommand, p *Producer) {
+	m.Describe("set", "<num> <object>", "sets the quantity of objects to n")
+	m.Register("set", func(args []string) error {
+		obj, quant, err := parseQuantityArgs("set", args)
+		if err != nil {
+			p.log.Error("parsing input", slog.Any("error", err))
+			return nil
+		}
+		return p.Set(context.Background(), obj, quant)
+	})
+}
+
+func registerAdjust(m *cli.MultiCommand, p *Producer) {
+	m.Describe(
+		"adjust", "<delta> <object>",
+		"adds a signed delta without checking invariants",
+	)
+	m.Register("adjust", func(args []string) error {
+		obj, delta, err := parseQuantityArgs("adjust", args)
+		if err != nil {
+			p.log.Error("parsing input", slog.Any("error", err))
+			return nil
+		}
+		if err := ValidateAdjustment(obj, delta); err != nil {
+			p.log.Error("invalid input", slog.Any("error", err))
+			return nil
+		}
+		return p.Adjust(context.Background(), obj, delta)
+	})
+}
+
+func registerTransfer(m *cli.MultiCommand, p *Producer) {
+	m.Describe(
+		"transfer", "<num> <source> <destination>",
+		"moves n objects from source to destination",
+	)
+	m.Register("transfer", func(args []string) error {
+		quant, src, dst, err := parseTransferArgs(args)
+		if err != nil {
+			p.log.Error("parsing input", slog.Any("error", err))
+			return nil
+		}
+		err = p.Transfer(context.Background(), src, dst, quant)
+		if errors.Is(err, ErrInsuffQuant) {
+			p.log.Error(
+				"can't transfer, insufficient quantity",
+				slog.String("source", src), slog.Int64("quantity", quant),
+			)
+			return nil
+		}
+		return err
+	})
+}
+
+func registerCheckpoint(m *cli.MultiCommand, p *Producer) {
+	m.Describe("checkpoint", "", "appends a checkpoint event")
+	m.Register("checkpoint", func(args []string) error {
+		v, err := p.Checkpoint(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  checkpoint version: %s\n", v)
+		return nil
+	})
+}
+
+func registerReplay(m *cli.MultiCommand, p *Producer) {
+	m.Describe("replay", "", "rebuilds the database from the log")
+	m.Register("replay", func(args []string) error {
+		if err := p.Replay(context.Background()); err != nil {
+			return err
+		}
+		fmt.Println("  replayed")
+		return nil
+	})
+}
+
+func registerCap(m *cli.MultiCommand, p *Producer) {
+	m.Describe("cap", "<object> <maximum>", "takes objects above a maximum")
+	m.Register("cap", func(args []string) error {
+		if len(args) != 2 {
+			p.log.Error("syntax error, expected: cap <object> <maximum>")
+			return nil
+		}
+		maximum, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			p.log.Error("parsing maximum", slog.Any("error", err))
+			return nil
+		}
+		excess, err := p.EnsureMaximum(
+			context.Background(), args[0], maximum,
+		)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  trimmed %d %s\n", excess, args[0])
+		return nil
+	})
+}
+
+func registerStats(m *cli.MultiCommand, p *Producer) {
+	m.Describe("stats", "", "prints producer statistics")
+	m.Register("stats", func(args []string) error {
+		s := p.Stats()
+		fmt.Printf("  transactions:       %d\n", s.Transactions)
+		fmt.Printf("  keys read:          %d\n", s.KeysRead)
+		fmt.Printf("  keys written:       %d\n", s.KeysWritten)
+		fmt.Printf("  bytes read:         %d\n", s.BytesRead)
+		fmt.Printf("  bytes written:      %d\n", s.BytesWritten)
+
+		gc, err := p.db.GCStats()
+		if err != nil {
+			return err
+		}
+		lastGCAt := "never"
+		if !gc.LastGCAt.IsZero() {
+			lastGCAt = gc.LastGCAt.Format(time.RFC3339Nano)
+		}
+		fmt.Printf("  GC runs:            %d\n", gc.RunCount)
+		fmt.Printf("  GC bytes reclaimed: %d\n", gc.BytesReclaimed)
+		fmt.Printf("  last GC at:         %s\n", lastGCAt)
+		fmt.Printf("  last GC duration:   %s\n", gc.LastGCDuration)
+		return nil
+	})
+}
+
+func registerAudit(m *cli.MultiCommand, p *Producer) {
+	m.Describe("audit", "[limit]", "prints the most recent operations")
+	m.Register("audit", func(args []string) error {
+		limit := 20
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				fmt.Printf("  invalid limit: %q\n", args[0])
+				return nil
+			}
+			limit = n
+		}
+		entries, err := p.Audit(limit)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			fmt.Printf(
+				"  %s %s: %s %s %d\n",
+				e.AppliedAt.Format(time.RFC3339Nano), e.Version,
+				e.Operation, e.Object, e.Quantity,
+			)
+		}
+		return nil
+	})
+}
+
+func registerDBStats(m *cli.MultiCommand, db *database.DB) {
+	m.Describe("db-stats", "", "prints database storage statistics as JSON")
+	m.Register("db-stats", func(args []string) error {
+		s, err := db.Stats()
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(s, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  %s\n", b)
+		return nil
+	})
+}
+
+func registerExit(m *cli.MultiCommand) {
+	m.Describe("exit", "", "exits the program")
+	m.Register("exit", func(args []string) error {
+		return cli.ErrAbortScan
+	})
+}
+
+// parseTransferArgs parses the <num> <source> <destination> arguments
+// of the transfer command.
+func parseTransferArgs(args []string) (
+	quantity int64,
+	source, destination string,
+	err error,
+) {
+	if len(args) != 3 {
+		err = errors.New(
+			"syntax error, expected: transfer <num> <source> <destination>",
+		)
+		return
+	}
+	if quantity, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+		err = fmt.Errorf("parsing number: %w", err)
+		return
+	}
+	source, destination = args[1], args[2]
+	err = ValidateTransfer(source, destination, quantity)
+	return
+}
+
+// parseQuantityArgs parses the <num> <object> arguments of command.
+func parseQuantityArgs(
+	command string,
+	args []string,
+) (object string, quantity int64, err error) {
+	if len(args) != 2 {
+		err = fmt.Errorf(
+			"syntax error, expected: %s <num> <object>", command,
+		)
+		return
+	}
+
+	n, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil {
+		err = fmt.Errorf("parsing number: %w", err)
+		return
+	}
+
+	return args[1], n, nil
+}
@@ -7,23 +7,49 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
 	"os"
-	"regexp"
-	"strconv"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/romshark/eventlog-example/cli"
+	"github.com/romshark/eventlog-example/config"
 	"github.com/romshark/eventlog-example/database"
 	"github.com/romshark/eventlog-example/event"
+	"github.com/romshark/eventlog-example/internal/projection"
+	"github.com/romshark/eventlog-example/internal/runner"
+	"github.com/romshark/eventlog-example/metrics"
+	"github.com/romshark/eventlog-example/otel"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/romshark/eventlog/client"
 	"github.com/romshark/eventlog/eventlog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 func main() {
 	var fHost string
 	var fDBDir string
 	var fEnableDBLog bool
+	var fDBStrict bool
+	var fGCInterval time.Duration
+	var fWarmUp bool
+	var fHistFile string
+	var fScript string
+	var fLogFormat string
+	var fMetricsAddr string
+	var fShutdownTimeout time.Duration
+	var fCLITimeout time.Duration
+	var fConfig string
+	var fPollInterval time.Duration
 	flag.StringVar(
 		&fHost, "log-addr", "localhost:9090", "event log server address",
 	)
@@ -33,248 +59,1960 @@ func main() {
 	flag.BoolVar(
 		&fEnableDBLog, "db-log", false, "enable database debug logging",
 	)
+	flag.BoolVar(
+		&fDBStrict, "db-strict", false, "enable strict consistency checks",
+	)
+	flag.DurationVar(
+		&fGCInterval, "gc-interval", 5*time.Minute,
+		"database value log GC interval (0=disabled)",
+	)
+	flag.BoolVar(
+		&fWarmUp, "warmup-on-start", false,
+		"pre-fetch the database keyspace into the cache on start",
+	)
+	flag.DurationVar(
+		&fPollInterval, "poll-interval", 0,
+		"poll the event log at this interval instead of listening (0=listen)",
+	)
+	flag.StringVar(
+		&fHistFile, "history-file", cli.DefaultHistoryFile(),
+		"command history file (empty=disabled)",
+	)
+	flag.StringVar(
+		&fScript, "script", "",
+		"file to read commands from instead of the terminal",
+	)
+	flag.StringVar(
+		&fLogFormat, "log-format", "text", "log format (text or json)",
+	)
+	flag.StringVar(
+		&fMetricsAddr, "metrics-addr", "localhost:9102",
+		"address /metrics is served on (empty=disabled)",
+	)
+	flag.DurationVar(
+		&fShutdownTimeout, "shutdown-timeout", 10*time.Second,
+		"maximum time to wait for in-flight work to finish on shutdown",
+	)
+	flag.DurationVar(
+		&fCLITimeout, "cli-timeout", 0,
+		"read commands from stdin without line editing and exit "+
+			"if none is entered within this duration (0=disabled)",
+	)
+	flag.StringVar(
+		&fConfig, "config", "",
+		"YAML configuration file, overridden by EVENTLOG_* environment "+
+			"variables and flags",
+	)
 	flag.Parse()
 
-	lApp := log.New(os.Stdout, "APP:", log.LstdFlags)
-	lDB := log.New(os.Stdout, "DB:", log.LstdFlags)
-	if !fEnableDBLog {
-		lDB.SetOutput(io.Discard)
+	cfg, err := config.Load(fConfig)
+	if err == nil {
+		err = cfg.Apply(flag.CommandLine)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	l, err := cli.NewLogger(os.Stdout, fLogFormat, slog.LevelDebug)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	lApp := l.With(slog.String("component", "app"))
+	lDB := l.With(slog.String("component", "db"))
+	if !fEnableDBLog {
+		lDB = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	db, err := database.Open(
+		fDBDir, lDB,
+		database.WithStrictConsistencyChecks(fDBStrict),
+		database.WithGCInterval(fGCInterval),
+	)
+	if err != nil {
+		lApp.Error("opening database", slog.Any("error", err))
+		os.Exit(1)
+	}
+	defer db.Close()
+	if fWarmUp {
+		go func() {
+			ctx, cancel := context.WithTimeout(
+				context.Background(), time.Minute,
+			)
+			defer cancel()
+			if err := db.WarmUp(ctx); err != nil {
+				lApp.Warn(
+					"database warm-up incomplete", slog.Any("error", err),
+				)
+			}
+		}()
+	}
+
+	var met *metrics.Metrics
+	if fMetricsAddr != "" {
+		met = metrics.New("producer")
+		if err := met.Register(prometheus.DefaultRegisterer); err != nil {
+			lApp.Error("registering metrics", slog.Any("error", err))
+			os.Exit(1)
+		}
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			err := http.ListenAndServe(fMetricsAddr, nil)
+			lApp.Error("serving metrics", slog.Any("error", err))
+		}()
+	}
+
+	httpc := client.NewHTTP(
+		fHost,
+		log.New(os.Stdout, "EVENTLOG CLIENT ERR:", log.LstdFlags),
+		nil, nil,
+	)
+	httpc.SetRetryInterval(time.Second)
+	ec := client.New(httpc)
+
+	opts := []Option{WithMetrics(met)}
+	if fPollInterval > 0 {
+		opts = append(
+			opts, WithSyncMode(SyncModePoll), WithPollInterval(fPollInterval),
+		)
+	}
+	// ctx is canceled on SIGINT, SIGTERM or when the CLI exits
+	ctx, stop := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+	defer stop()
+
+	opts = append(opts, WithErrorHandler(func(err error) {
+		lApp.Error("running producer", slog.Any("error", err))
+		db.Close()
+		os.Exit(1)
+	}))
+	p := NewProducer(db, ec, lApp, opts...)
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		if err := runner.RunWithRecovery(
+			ctx, lApp, p.Run,
+			func(r interface{}) {
+				lApp.Error("recovered from panic", slog.Any("panic", r))
+			},
+		); err != nil {
+			if !errors.Is(err, context.Canceled) &&
+				!errors.Is(err, context.DeadlineExceeded) {
+				lApp.Error("running producer", slog.Any("error", err))
+				db.Close()
+				os.Exit(1)
+			}
+		}
+	}()
+
+	var m cli.MultiCommand
+	registerCommands(&m, p)
+
+	onInput := func(ln string) error {
+		err := m.Dispatch(ln)
+		switch {
+		case errors.Is(err, cli.ErrUnknownCommand),
+			errors.Is(err, cli.ErrEmptyInput),
+			errors.Is(err, cli.ErrUnterminatedQuote):
+			lApp.Error("parsing input", slog.Any("error", err))
+			return nil
+		}
+		return err
+	}
+	cliDone := make(chan error, 1)
+	go func() {
+		if fScript != "" {
+			cliDone <- cli.ScanLinesFromFile(fScript, onInput)
+			return
+		}
+		if fCLITimeout > 0 {
+			err := cli.ScanLinesWithTimeout(os.Stdin, fCLITimeout, onInput)
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			cliDone <- err
+			return
+		}
+		fmt.Println(`commands: `)
+		fmt.Print(m.Help())
+		fmt.Println("---------------------")
+		cliDone <- cli.ScanLinesWithHistory(fHistFile, m.Names(), onInput)
+	}()
+	select {
+	case err := <-cliDone:
+		if err != nil {
+			lApp.Error("CLI", slog.Any("error", err))
+		}
+	case <-ctx.Done():
+		lApp.Info("received shutdown signal")
+	}
+
+	stop()
+	select {
+	case <-runDone:
+	case <-time.After(fShutdownTimeout):
+		lApp.Error(
+			"producer didn't stop in time",
+			slog.Duration("timeout", fShutdownTimeout),
+		)
+		os.Exit(1)
+	}
+}
+
+// Producer is an event producer and an aggregate enforcing invariants.
+// It stores its projection of the current state of the world in a database.
+type Producer struct {
+	db             *database.DB
+	c              *client.Client
+	log            *slog.Logger
+	versionTimeout time.Duration
+	opTimeout      time.Duration
+	id             string
+	idemWindow     time.Duration
+	syncMode       SyncMode
+	pollInterval   time.Duration
+	listenFailures int
+	metrics        *metrics.Metrics
+	onError        func(error)
+	applyHook      func(tx *database.Tx, e client.Event) error
+
+	// replayBatchSize is the maximum number of events
+	// replayed within a single transaction by Replay
+	replayBatchSize int
+
+	// maxQuantity maps objects to their maximum quantity
+	maxQuantity map[string]int64
+
+	observersLock sync.Mutex
+	observers     map[string]map[chan Observation]struct{}
+
+	statsLock sync.Mutex
+	stats     Stats
+
+	retryPolicyLock sync.Mutex
+	retryPolicy     RetryPolicy
+
+	objectValidatorLock sync.Mutex
+	objectValidator     func(object string) error
+
+	syncGroup singleflight.Group
+}
+
+// Stats are producer statistics.
+type Stats struct {
+	// Transactions is the number of committed transactions.
+	Transactions int64
+
+	// TxStats are the accumulated statistics
+	// of all committed transactions.
+	database.TxStats
+}
+
+// Option configures a Producer.
+type Option func(*Producer)
+
+// WithVersionTimeout makes RunUntil return ErrVersionTimeout
+// if the target version isn't reached within d.
+func WithVersionTimeout(d time.Duration) Option {
+	return func(p *Producer) { p.versionTimeout = d }
+}
+
+// WithOperationTimeout makes Put and Take of a BoundProducer time out
+// after d (see Producer.WithContext).
+func WithOperationTimeout(d time.Duration) Option {
+	return func(p *Producer) { p.opTimeout = d }
+}
+
+// WithID sets the producer ID written to checkpoint events.
+// The default ID is composed of the host name and the process ID.
+func WithID(id string) Option {
+	return func(p *Producer) { p.id = id }
+}
+
+// WithIdempotencyWindow sets the duration for which AppendIdempotent
+// remembers idempotency tokens. The default window is 24 hours.
+func WithIdempotencyWindow(d time.Duration) Option {
+	return func(p *Producer) { p.idemWindow = d }
+}
+
+// SyncMode defines how Run learns about new events.
+type SyncMode int
+
+const (
+	// SyncModeListen synchronizes whenever the event log notifies
+	// about new events.
+	SyncModeListen SyncMode = iota
+
+	// SyncModePoll synchronizes periodically at the poll interval.
+	SyncModePoll
+)
+
+// WithSyncMode sets the synchronization mode of Run.
+// The default mode is SyncModeListen.
+func WithSyncMode(mode SyncMode) Option {
+	return func(p *Producer) { p.syncMode = mode }
+}
+
+// WithPollInterval sets the interval at which Run synchronizes
+// in SyncModePoll. The default interval is one second.
+func WithPollInterval(d time.Duration) Option {
+	return func(p *Producer) { p.pollInterval = d }
+}
+
+// WithListenFailureLimit makes Run fall back to SyncModePoll after
+// listening failed n times in a row. The default limit is 3.
+// A limit below 1 disables the fallback making Run return the error
+// listening failed with instead.
+func WithListenFailureLimit(n int) Option {
+	return func(p *Producer) { p.listenFailures = n }
+}
+
+// WithMaxQuantity caps the quantity of object at limit. Appends that would
+// exceed the cap fail with ErrExceedsCap. Objects aren't capped by default.
+func WithMaxQuantity(object string, limit int64) Option {
+	return func(p *Producer) {
+		if p.maxQuantity == nil {
+			p.maxQuantity = map[string]int64{}
+		}
+		p.maxQuantity[object] = limit
+	}
+}
+
+// WithMetrics sets the metrics updated by the producer.
+// Metrics aren't collected by default.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(p *Producer) { p.metrics = m }
+}
+
+// WithApplyHook makes the producer call fn after each event is applied
+// within the same transaction, which allows extending the way events are
+// applied, for example before calling Replay. If fn returns an error
+// the transaction is discarded.
+func WithApplyHook(fn func(tx *database.Tx, e client.Event) error) Option {
+	return func(p *Producer) { p.applyHook = fn }
+}
+
+// WithReplayBatchSize sets the maximum number of events Replay applies
+// within a single transaction. The default batch size is 1000 events.
+func WithReplayBatchSize(n int) Option {
+	return func(p *Producer) { p.replayBatchSize = n }
+}
+
+// WithErrorHandler makes Run call fn with errors synchronizing
+// on updates. By default such errors are logged and stop Run,
+// which then returns the error.
+func WithErrorHandler(fn func(error)) Option {
+	return func(p *Producer) { p.onError = fn }
+}
+
+// NewProducer creates a new producer.
+func NewProducer(
+	db *database.DB,
+	c *client.Client,
+	l *slog.Logger,
+	opts ...Option,
+) *Producer {
+	p := &Producer{
+		db:           db,
+		c:            c,
+		log:          l,
+		observers:    map[string]map[chan Observation]struct{}{},
+		idemWindow:   24 * time.Hour,
+		pollInterval: time.Second,
+
+		listenFailures: 3,
+
+		replayBatchSize: 1000,
+	}
+	host, _ := os.Hostname()
+	p.id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	for _, o := range opts {
+		o(p)
+	}
+	return p
+}
+
+// WithContext returns p bound to baseCtx. The Put and Take methods of the
+// returned BoundProducer derive their context from baseCtx timing out after
+// the duration set by WithOperationTimeout and its Run stops once baseCtx
+// is canceled.
+func (p *Producer) WithContext(baseCtx context.Context) *BoundProducer {
+	return &BoundProducer{p: p, baseCtx: baseCtx}
+}
+
+// BoundProducer is a Producer bound to a base context (see
+// Producer.WithContext). It shares the database, the observers,
+// the statistics and all other state with the Producer it was created from.
+type BoundProducer struct {
+	p       *Producer
+	baseCtx context.Context
+}
+
+// Put is similar to Producer.Put but runs within a context derived
+// from the base context.
+func (b *BoundProducer) Put(
+	object string,
+	quantity int64,
+	opts ...AppendOption,
+) error {
+	ctx, cancel := b.opContext()
+	defer cancel()
+	return b.p.Put(ctx, object, quantity, opts...)
+}
+
+// Take is similar to Producer.Take but runs within a context derived
+// from the base context.
+func (b *BoundProducer) Take(
+	object string,
+	quantity int64,
+	opts ...AppendOption,
+) error {
+	ctx, cancel := b.opContext()
+	defer cancel()
+	return b.p.Take(ctx, object, quantity, opts...)
+}
+
+// Run is similar to Producer.Run but runs until the base context
+// is canceled.
+func (b *BoundProducer) Run() error { return b.p.Run(b.baseCtx) }
+
+// opContext returns a context derived from the base context timing out
+// after the duration set by WithOperationTimeout.
+func (b *BoundProducer) opContext() (context.Context, context.CancelFunc) {
+	if b.p.opTimeout > 0 {
+		return context.WithTimeout(b.baseCtx, b.p.opTimeout)
+	}
+	return context.WithCancel(b.baseCtx)
+}
+
+// Run synchronizes the database and begins listening for new events
+// as long as ctx is not canceled. In SyncModePoll, or after listening
+// failed too often, Run polls the event log using SyncInterval instead.
+func (p *Producer) Run(ctx context.Context) (err error) {
+	if _, err := p.Sync(context.Background(), nil); err != nil {
+		return fmt.Errorf("synchronizing: %w", err)
+	}
+
+	if p.syncMode == SyncModePoll {
+		return p.SyncInterval(ctx, p.pollInterval)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var errSync error
+	onError := p.onError
+	if onError == nil {
+		onError = func(err error) {
+			p.log.Error("synchronizing on update", slog.Any("error", err))
+			errSync = err
+			cancel()
+		}
+	}
+
+	p.log.Info("listening for updates")
+	for failures := 0; ; {
+		updated := false
+		err = p.c.Listen(ctx, func(v client.Version) {
+			updated = true
+			p.log.Info("update received", slog.String("version", v))
+			p.updateLag(v)
+			if _, err := p.Sync(ctx, nil); err != nil {
+				onError(fmt.Errorf("synchronizing: %w", err))
+				return
+			}
+			p.updateLag(v)
+		})
+		if errSync != nil {
+			return errSync
+		}
+		if ctx.Err() != nil || p.listenFailures < 1 {
+			return err
+		}
+		if updated {
+			failures = 0
+		}
+		failures++
+		p.log.Warn(
+			"listening failed",
+			slog.Int("failures", failures),
+			slog.Int("limit", p.listenFailures),
+			slog.Any("error", err),
+		)
+		if failures >= p.listenFailures {
+			p.log.Warn(
+				"falling back to polling",
+				slog.Duration("interval", p.pollInterval),
+			)
+			return p.SyncInterval(ctx, p.pollInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.pollInterval):
+		}
+	}
+}
+
+// SyncInterval synchronizes the database every interval
+// until ctx is canceled, which doesn't require the event log
+// to support listening for updates.
+func (p *Producer) SyncInterval(
+	ctx context.Context,
+	interval time.Duration,
+) error {
+	p.log.Info("polling for updates", slog.Duration("interval", interval))
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		if _, err := p.Sync(ctx, nil); err != nil {
+			return fmt.Errorf("synchronizing: %w", err)
+		}
+	}
+}
+
+// RunUntil synchronizes the database and listens for new events
+// until the projection reaches targetVersion.
+// ErrVersionTimeout is returned if targetVersion isn't reached within
+// the duration set by WithVersionTimeout.
+func (p *Producer) RunUntil(
+	ctx context.Context,
+	targetVersion client.Version,
+) (err error) {
+	if p.versionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.versionTimeout)
+		defer cancel()
+		defer func() {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = ErrVersionTimeout
+			}
+		}()
+	}
+
+	reached, err := p.syncUntil(ctx, targetVersion)
+	if err != nil {
+		return fmt.Errorf("synchronizing: %w", err)
+	}
+	if reached {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p.log.Info(
+		"listening for updates until version",
+		slog.String("version", targetVersion),
+	)
+	var errSync error
+	err = p.c.Listen(ctx, func(v client.Version) {
+		p.log.Info("update received", slog.String("version", v))
+		reached, errSync = p.syncUntil(ctx, targetVersion)
+		if errSync != nil || reached {
+			cancel()
+		}
+	})
+	switch {
+	case errSync != nil:
+		return fmt.Errorf("synchronizing: %w", errSync)
+	case reached:
+		p.log.Info("reached version", slog.String("version", targetVersion))
+		return nil
+	}
+	return err
+}
+
+var ErrVersionTimeout = errors.New("target version not reached in time")
+
+// syncUntil synchronizes the database and returns true
+// if the projection version reached targetVersion.
+func (p *Producer) syncUntil(
+	ctx context.Context,
+	targetVersion client.Version,
+) (reached bool, err error) {
+	if _, err = p.Sync(ctx, nil); err != nil {
+		return false, err
+	}
+	var v client.Version
+	if err = p.withinTx(database.ReadOnly, func(tx *database.Tx) error {
+		v, err = tx.GetProjectionVersion()
+		return err
+	}); err != nil {
+		return false, fmt.Errorf("reading projection version: %w", err)
+	}
+	return database.CompareVersions(v, targetVersion) >= 0, nil
+}
+
+// Observation is a change of the stored quantity of an object.
+type Observation struct {
+	Object    string
+	Quantity  int64
+	Version   client.Version
+	Timestamp time.Time
+
+	// RecordedAt is the time the event occurred at according
+	// to its producer.
+	RecordedAt time.Time
+}
+
+// ObservationStream receives observations of an object on C
+// until it's closed.
+type ObservationStream struct {
+	C     <-chan Observation
+	close func()
+}
+
+// Close stops the stream and closes C.
+func (s ObservationStream) Close() error {
+	s.close()
+	return nil
+}
+
+// Observe subscribes to changes of the quantity of object
+// until either ctx is canceled or the stream is closed.
+// Observations are dropped if the receiver falls behind.
+func (p *Producer) Observe(
+	ctx context.Context,
+	object string,
+) (ObservationStream, error) {
+	if err := ValidateInput(object, 0); err != nil {
+		return ObservationStream{}, err
+	}
+
+	ch := make(chan Observation, 64)
+	p.observersLock.Lock()
+	if p.observers[object] == nil {
+		p.observers[object] = map[chan Observation]struct{}{}
+	}
+	p.observers[object][ch] = struct{}{}
+	p.observersLock.Unlock()
+
+	done := make(chan struct{})
+	var once sync.Once
+	closeFn := func() {
+		once.Do(func() {
+			p.observersLock.Lock()
+			defer p.observersLock.Unlock()
+			delete(p.observers[object], ch)
+			if len(p.observers[object]) < 1 {
+				delete(p.observers, object)
+			}
+			close(ch)
+			close(done)
+		})
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeFn()
+		case <-done:
+		}
+	}()
+
+	return ObservationStream{C: ch, close: closeFn}, nil
+}
+
+// publish sends o to all observers of o.Object.
+func (p *Producer) publish(o Observation) {
+	p.observersLock.Lock()
+	defer p.observersLock.Unlock()
+	for ch := range p.observers[o.Object] {
+		select {
+		case ch <- o:
+		default:
+			p.log.Warn(
+				"observer fell behind, dropping observation",
+				slog.String("object", o.Object),
+			)
+		}
+	}
+}
+
+// AppendOption configures an individual append.
+type AppendOption func(*appendOptions)
+
+type appendOptions struct {
+	idempotencyKey string
+	meta           map[string]string
+}
+
+func newAppendOptions(opts []AppendOption) (o appendOptions) {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return
+}
+
+// WithIdempotencyKey sets the idempotency key of the appended event.
+// Events carrying an already applied key are skipped by all projections,
+// which makes it safe to retry an append when the connection drops
+// before the response is received.
+func WithIdempotencyKey(key string) AppendOption {
+	return func(o *appendOptions) { o.idempotencyKey = key }
+}
+
+// WithMeta annotates the appended event with the given key-value pair
+// (see event.Event.Meta). Setting the same key again overwrites it.
+func WithMeta(key, value string) AppendOption {
+	return func(o *appendOptions) {
+		if o.meta == nil {
+			o.meta = make(map[string]string)
+		}
+		o.meta[key] = value
+	}
+}
+
+// Put puts objects of the given type onto the pile.
+func (p *Producer) Put(
+	ctx context.Context,
+	object string,
+	quantity int64,
+	opts ...AppendOption,
+) (err error) {
+	ctx, span := otel.Tracer().Start(ctx, "Producer.Put", trace.WithAttributes(
+		attribute.String("operation", "put"),
+		attribute.String("object", object),
+		attribute.Int64("quantity", quantity),
+	))
+	defer func() { otel.End(span, err) }()
+
+	if err := ValidateInput(object, quantity); err != nil {
+		return err
+	}
+	if err := p.validateObjects(object); err != nil {
+		return err
+	}
+	o := newAppendOptions(opts)
+
+	ev, err := event.Encode(otel.InjectTraceContext(event.Event{
+		Operation:      "put",
+		Object:         object,
+		Quantity:       quantity,
+		IdempotencyKey: o.idempotencyKey,
+		Meta:           o.meta,
+	}, ctx))
+	if err != nil {
+		return err
+	}
+	return p.appendWithinCaps(ctx, map[string]int64{object: quantity}, ev)
+}
+
+// Set replaces the quantity of the given type of objects in the pile.
+// Unlike Put and Take it doesn't depend on the current quantity
+// and therefore requires no invariant checking.
+func (p *Producer) Set(
+	ctx context.Context,
+	object string,
+	quantity int64,
+) error {
+
+	if err := ValidateInput(object, quantity); err != nil {
+		return err
+	}
+	if err := p.validateObjects(object); err != nil {
+		return err
+	}
+	if limit, ok := p.maxQuantity[object]; ok && quantity > limit {
+		return fmt.Errorf("%w: %q", ErrExceedsCap, object)
+	}
+
+	ev, err := event.Encode(event.Event{
+		Operation: "set",
+		Object:    object,
+		Quantity:  quantity,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, _, _, err = p.c.Append(ctx, ev)
+	return p.countAppended(1, err)
+}
+
+// Adjust adds delta to the quantity of the given type of objects,
+// removing objects if delta is negative. Unlike Take it doesn't check
+// whether enough objects are stored and is meant for administrative
+// corrections, objects are deleted once their quantity drops to zero.
+func (p *Producer) Adjust(
+	ctx context.Context,
+	object string,
+	delta int64,
+) error {
+
+	if err := ValidateAdjustment(object, delta); err != nil {
+		return err
+	}
+	if err := p.validateObjects(object); err != nil {
+		return err
+	}
+
+	ev, err := event.Encode(event.Event{
+		Operation: "adjust",
+		Object:    object,
+		Quantity:  delta,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, _, _, err = p.c.Append(ctx, ev)
+	return p.countAppended(1, err)
+}
+
+// PutWithExpiry puts objects of the given type onto the pile
+// and schedules them to expire at expiresAt.
+func (p *Producer) PutWithExpiry(
+	ctx context.Context,
+	object string,
+	quantity int64,
+	expiresAt time.Time,
+) error {
+
+	if err := ValidateInput(object, quantity); err != nil {
+		return err
+	}
+	if err := p.validateObjects(object); err != nil {
+		return err
+	}
+
+	put, err := event.Encode(event.Event{
+		Operation: "put",
+		Object:    object,
+		Quantity:  quantity,
+	})
+	if err != nil {
+		return err
+	}
+	expire, err := event.Encode(event.Event{
+		Operation: "expire",
+		Object:    object,
+		Quantity:  quantity,
+		ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.appendWithinCaps(
+		ctx, map[string]int64{object: quantity}, put, expire,
+	)
+}
+
+// Take takes objects of the given type from the pile.
+// ErrInsuffQuant is returned if there aren't enough unreserved instances
+// stored.
+func (p *Producer) Take(
+	ctx context.Context,
+	object string,
+	quantity int64,
+	opts ...AppendOption,
+) (err error) {
+	ctx, span := otel.Tracer().Start(ctx, "Producer.Take", trace.WithAttributes(
+		attribute.String("operation", "take"),
+		attribute.String("object", object),
+		attribute.Int64("quantity", quantity),
+	))
+	defer func() { otel.End(span, err) }()
+
+	if err := ValidateInput(object, quantity); err != nil {
+		return err
+	}
+	if err := p.validateObjects(object); err != nil {
+		return err
+	}
+	o := newAppendOptions(opts)
+	return p.withinTx(database.ReadWrite, func(t *database.Tx) error {
+		// Get the current version projected by the database
+		// and try to append a Take event onto it.
+		v, err := assumedVersion(t)
+		if err != nil {
+			return fmt.Errorf("reading projection version: %w", err)
+		}
+		_, _, _, err = p.c.TryAppend(
+			ctx, v,
+			// Transaction will either return ErrInsuffQuant if there aren't
+			// enough instances of the requested object stored in the database
+			// or the Take event that's written to the eventlog.
+			func() (client.EventData, error) {
+				// Make sure there's enough instances of the object stored!
+				q, err := available(t, object)
+				if err != nil {
+					return eventlog.EventData{}, err
+				}
+				if q-quantity < 0 {
+					return eventlog.EventData{}, ErrInsuffQuant
+				}
+
+				ev, err := event.Encode(otel.InjectTraceContext(event.Event{
+					Operation:      "take",
+					Object:         object,
+					Quantity:       quantity,
+					IdempotencyKey: o.idempotencyKey,
+					Meta:           o.meta,
+				}, ctx))
+				return ev, err
+			},
+			// Sync will be called if client.AppendCheck fails due to a
+			// client.ErrMismatchingVersions error, which indicates
+			// that the projection of this service is outdated and must
+			// first be updated to make sure no invariants are accepted.
+			p.retrySync(ctx, t),
+		)
+		return p.countAppended(1, err)
+	})
+}
+
+var ErrInsuffQuant = errors.New("insufficient quantity stored")
+
+// available returns the stored quantity of object that isn't reserved.
+func available(t *database.Tx, object string) (int64, error) {
+	q, err := t.GetQuantity(object)
+	if err != nil {
+		return 0, err
+	}
+	reserved, err := t.GetReserved(object)
+	if err != nil {
+		return 0, err
+	}
+	return q - reserved, nil
+}
+
+// Reserve reserves quantity objects of the given type for reservationID.
+// Reserved objects remain stored but can't be taken until released.
+// ErrInsuffQuant is returned if there aren't enough unreserved
+// instances stored and ErrReservationExists if reservationID
+// is already in use.
+func (p *Producer) Reserve(
+	ctx context.Context,
+	object string,
+	quantity int64,
+	reservationID string,
+) error {
+	return p.appendReservation(ctx, event.Event{
+		Operation:     "reserve",
+		Object:        object,
+		Quantity:      quantity,
+		ReservationID: reservationID,
+	}, func(t *database.Tx) error {
+		_, _, ok, err := t.GetReservation(reservationID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return ErrReservationExists
+		}
+		q, err := available(t, object)
+		if err != nil {
+			return err
+		}
+		if q < quantity {
+			return ErrInsuffQuant
+		}
+		return nil
+	})
+}
+
+var ErrReservationExists = errors.New("reservation already exists")
+
+// Release releases quantity reserved objects of the given type
+// of reservationID. If take is true the released objects are taken,
+// otherwise the reservation is canceled. ErrUnknownReservation is returned
+// if reservationID doesn't reserve objects of the given type, for example
+// because it was released entirely before, and ErrInsuffReserved
+// if it reserves less than quantity objects.
+func (p *Producer) Release(
+	ctx context.Context,
+	object string,
+	quantity int64,
+	reservationID string,
+	take bool,
+) error {
+	return p.appendReservation(ctx, event.Event{
+		Operation:     "release",
+		Object:        object,
+		Quantity:      quantity,
+		ReservationID: reservationID,
+		Take:          take,
+	}, func(t *database.Tx) error {
+		o, q, ok, err := t.GetReservation(reservationID)
+		if err != nil {
+			return err
+		}
+		if !ok || o != object {
+			return ErrUnknownReservation
+		}
+		if q < quantity {
+			return ErrInsuffReserved
+		}
+		return nil
+	})
+}
+
+var (
+	ErrUnknownReservation = errors.New("unknown reservation")
+	ErrInsuffReserved     = errors.New("insufficient quantity reserved")
+)
+
+// appendReservation appends reservation event e once check accepts it
+// at the projected version the event is appended onto.
+func (p *Producer) appendReservation(
+	ctx context.Context,
+	e event.Event,
+	check func(t *database.Tx) error,
+) error {
+
+	if err := ValidateInput(e.Object, e.Quantity); err != nil {
+		return err
+	}
+	if err := p.validateObjects(e.Object); err != nil {
+		return err
+	}
+	if e.ReservationID == "" {
+		return fmt.Errorf("invalid reservation id: %q", e.ReservationID)
+	}
+	return p.withinTx(database.ReadWrite, func(t *database.Tx) error {
+		v, err := assumedVersion(t)
+		if err != nil {
+			return fmt.Errorf("reading projection version: %w", err)
+		}
+		_, _, _, err = p.c.TryAppend(
+			ctx, v,
+			func() (client.EventData, error) {
+				if err := check(t); err != nil {
+					return eventlog.EventData{}, err
+				}
+				return event.Encode(e)
+			},
+			p.retrySync(ctx, t),
+		)
+		return p.countAppended(1, err)
+	})
+}
+
+// BulkPut puts objects of multiple types onto the pile
+// in a single event.
+func (p *Producer) BulkPut(
+	ctx context.Context,
+	items map[string]int64,
+) error {
+
+	if err := validateItems(items); err != nil {
+		return err
+	}
+	if err := p.validateItemObjects(items); err != nil {
+		return err
+	}
+
+	ev, err := event.Encode(event.Event{
+		Operation: "bulk-put",
+		Items:     items,
+	})
+	if err != nil {
+		return err
+	}
+	return p.appendWithinCaps(ctx, items, ev)
+}
+
+// appendWithinCaps appends events adding the quantities of items.
+// Unless any of the objects is capped by WithMaxQuantity no invariant
+// checking is required, otherwise ErrExceedsCap is returned if any
+// of the resulting quantities would exceed its cap.
+func (p *Producer) appendWithinCaps(
+	ctx context.Context,
+	items map[string]int64,
+	events ...client.EventData,
+) error {
+	capped := false
+	for o := range items {
+		if _, ok := p.maxQuantity[o]; ok {
+			capped = true
+			break
+		}
+	}
+	if !capped {
+		_, _, _, _, err := p.c.AppendMulti(ctx, events...)
+		return p.countAppended(len(events), err)
+	}
+	return p.withinTx(database.ReadWrite, func(t *database.Tx) error {
+		v, err := assumedVersion(t)
+		if err != nil {
+			return fmt.Errorf("reading projection version: %w", err)
+		}
+		_, _, _, _, err = p.c.TryAppendMulti(
+			ctx, v,
+			func() ([]client.EventData, error) {
+				for o, q := range items {
+					if err := p.checkCap(t, o, q); err != nil {
+						return nil, err
+					}
+				}
+				return events, nil
+			},
+			p.retrySync(ctx, t),
+		)
+		return p.countAppended(len(events), err)
+	})
+}
+
+// checkCap returns ErrExceedsCap if adding delta to the stored quantity
+// of object would exceed its cap.
+func (p *Producer) checkCap(t *database.Tx, object string, delta int64) error {
+	limit, ok := p.maxQuantity[object]
+	if !ok {
+		return nil
+	}
+	q, err := t.GetQuantity(object)
+	if err != nil {
+		return err
+	}
+	if q+delta > limit {
+		return fmt.Errorf("%w: %q", ErrExceedsCap, object)
+	}
+	return nil
+}
+
+var ErrExceedsCap = errors.New("maximum quantity exceeded")
+
+// BulkTake takes objects of multiple types from the pile
+// in a single event. Either all items are taken or none.
+// ErrInsuffQuant is returned if there aren't enough instances
+// of any of the objects stored.
+func (p *Producer) BulkTake(
+	ctx context.Context,
+	items map[string]int64,
+) error {
+
+	if err := validateItems(items); err != nil {
+		return err
+	}
+	if err := p.validateItemObjects(items); err != nil {
+		return err
+	}
+	return p.withinTx(database.ReadWrite, func(t *database.Tx) error {
+		v, err := assumedVersion(t)
+		if err != nil {
+			return fmt.Errorf("reading projection version: %w", err)
+		}
+		_, _, _, err = p.c.TryAppend(
+			ctx, v,
+			func() (client.EventData, error) {
+				for object, quantity := range items {
+					q, err := available(t, object)
+					if err != nil {
+						return eventlog.EventData{}, err
+					}
+					if q-quantity < 0 {
+						return eventlog.EventData{}, fmt.Errorf(
+							"%w: %q", ErrInsuffQuant, object,
+						)
+					}
+				}
+				return event.Encode(event.Event{
+					Operation: "bulk-take",
+					Items:     items,
+				})
+			},
+			p.retrySync(ctx, t),
+		)
+		return p.countAppended(1, err)
+	})
+}
+
+// EnsureMaximum takes the excess quantity of object if more than maximum
+// instances are stored and returns the quantity taken.
+func (p *Producer) EnsureMaximum(
+	ctx context.Context,
+	object string,
+	maximum int64,
+) (excess int64, err error) {
+
+	if err := ValidateInput(object, maximum); err != nil {
+		return 0, err
+	}
+	if err := p.validateObjects(object); err != nil {
+		return 0, err
+	}
+	err = p.withinTx(database.ReadWrite, func(t *database.Tx) error {
+		v, err := assumedVersion(t)
+		if err != nil {
+			return fmt.Errorf("reading projection version: %w", err)
+		}
+		_, _, _, err = p.c.TryAppend(
+			ctx, v,
+			func() (client.EventData, error) {
+				// Re-evaluated on every attempt
+				excess = 0
+				q, err := t.GetQuantity(object)
+				if err != nil {
+					return eventlog.EventData{}, err
+				}
+				if q <= maximum {
+					return eventlog.EventData{}, errWithinBounds
+				}
+				excess = q - maximum
+				return event.Encode(event.Event{
+					Operation: "take",
+					Object:    object,
+					Quantity:  excess,
+				})
+			},
+			p.retrySync(ctx, t),
+		)
+		return p.countAppended(1, err)
+	})
+	if errors.Is(err, errWithinBounds) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return excess, nil
+}
+
+// errWithinBounds aborts EnsureMaximum if no excess quantity is stored.
+var errWithinBounds = errors.New("within bounds")
+
+// TransferWithInvariant moves quantity objects of type from to type to
+// by appending a take and a put event atomically. check is called with
+// the current quantities of both objects and aborts the transfer if it
+// returns an error, which is then returned. check is called again with
+// the updated quantities if the projection turns out to be outdated.
+// ErrInsuffQuant is returned if there aren't enough objects of type from
+// and ErrExceedsCap if the transfer would exceed the cap of type to.
+func (p *Producer) TransferWithInvariant(
+	ctx context.Context,
+	from, to string,
+	quantity int64,
+	check func(fromQ, toQ int64) error,
+) error {
+
+	if err := ValidateTransfer(from, to, quantity); err != nil {
+		return err
+	}
+	if err := p.validateObjects(from, to); err != nil {
+		return err
+	}
+	return p.withinTx(database.ReadWrite, func(t *database.Tx) error {
+		v, err := assumedVersion(t)
+		if err != nil {
+			return fmt.Errorf("reading projection version: %w", err)
+		}
+		_, _, _, _, err = p.c.TryAppendMulti(
+			ctx, v,
+			func() ([]client.EventData, error) {
+				fromQ, err := t.GetQuantity(from)
+				if err != nil {
+					return nil, err
+				}
+				toQ, err := t.GetQuantity(to)
+				if err != nil {
+					return nil, err
+				}
+				fromAvailable, err := available(t, from)
+				if err != nil {
+					return nil, err
+				}
+				if fromAvailable-quantity < 0 {
+					return nil, ErrInsuffQuant
+				}
+				if err := p.checkCap(t, to, quantity); err != nil {
+					return nil, err
+				}
+				if err := check(fromQ, toQ); err != nil {
+					return nil, err
+				}
+
+				take, err := event.Encode(event.Event{
+					Operation: "take",
+					Object:    from,
+					Quantity:  quantity,
+				})
+				if err != nil {
+					return nil, err
+				}
+				put, err := event.Encode(event.Event{
+					Operation: "put",
+					Object:    to,
+					Quantity:  quantity,
+				})
+				if err != nil {
+					return nil, err
+				}
+				return []client.EventData{take, put}, nil
+			},
+			p.retrySync(ctx, t),
+		)
+		return p.countAppended(2, err)
+	})
+}
+
+var ErrSameObject = errors.New("source and destination object are equal")
+
+// Transfer moves quantity objects of type source to type destination
+// by appending a single transfer event.
+// ErrInsuffQuant is returned if there aren't enough objects of type source.
+func (p *Producer) Transfer(
+	ctx context.Context,
+	source, destination string,
+	quantity int64,
+) error {
+
+	if err := ValidateTransfer(source, destination, quantity); err != nil {
+		return err
+	}
+	if err := p.validateObjects(source, destination); err != nil {
+		return err
+	}
+	return p.withinTx(database.ReadWrite, func(t *database.Tx) error {
+		v, err := assumedVersion(t)
+		if err != nil {
+			return fmt.Errorf("reading projection version: %w", err)
+		}
+		_, _, _, err = p.c.TryAppend(
+			ctx, v,
+			func() (client.EventData, error) {
+				q, err := available(t, source)
+				if err != nil {
+					return eventlog.EventData{}, err
+				}
+				if q-quantity < 0 {
+					return eventlog.EventData{}, ErrInsuffQuant
+				}
+				if err := p.checkCap(t, destination, quantity); err != nil {
+					return eventlog.EventData{}, err
+				}
+				return event.Encode(event.Event{
+					Operation:   "transfer",
+					Source:      source,
+					Destination: destination,
+					Quantity:    quantity,
+				})
+			},
+			p.retrySync(ctx, t),
+		)
+		return p.countAppended(1, err)
+	})
+}
+
+// Checkpoint appends a checkpoint event, which doesn't modify any objects,
+// and returns its version. Consumers can synchronize to the returned version
+// to agree on a common point in the log.
+func (p *Producer) Checkpoint(ctx context.Context) (client.Version, error) {
+
+	ev, err := event.EncodeCheckpoint(event.Checkpoint{
+		ProducerID: p.id,
+		Timestamp:  time.Now().UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+	_, v, _, err := p.c.Append(ctx, ev)
+	return v, p.countAppended(1, err)
+}
+
+// AppendIdempotent appends ev unless an event was already appended
+// with the same idempotency token within the idempotency window, in which
+// case the version of the previously appended event is returned
+// and alreadyExists is true. The token is reserved before ev is appended
+// so that concurrent calls with the same token append at most once,
+// all but one of them fail with ErrIdempotencyTokenPending.
+// The token is deleted again if appending ev fails.
+func (p *Producer) AppendIdempotent(
+	ctx context.Context,
+	idempotencyToken string,
+	ev event.Event,
+) (version client.Version, alreadyExists bool, err error) {
+
+	if err := ValidateInput(ev.Object, ev.Quantity); err != nil {
+		return "", false, err
+	}
+	if err := p.validateObjects(ev.Object); err != nil {
+		return "", false, err
+	}
+	data, err := event.Encode(ev)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Reserve the token with an empty version in a committed transaction
+	// before appending, the append itself can't be rolled back
+	err = p.withinTx(database.ReadWrite, func(tx *database.Tx) error {
+		version, alreadyExists, err = tx.GetIdempotencyToken(idempotencyToken)
+		if err != nil || alreadyExists {
+			return err
+		}
+		return tx.SetIdempotencyToken(idempotencyToken, "", p.idemWindow)
+	})
+	switch {
+	case errors.Is(err, database.ErrConflict):
+		return "", false, ErrIdempotencyTokenPending
+	case err != nil:
+		return "", false, err
+	case alreadyExists && version == "":
+		return "", false, ErrIdempotencyTokenPending
+	case alreadyExists:
+		return version, true, nil
+	}
+
+	_, version, _, err = p.c.Append(ctx, data)
+	if err = p.countAppended(1, err); err != nil {
+		if errDel := p.withinTx(database.ReadWrite, func(
+			tx *database.Tx,
+		) error {
+			return tx.DeleteIdempotencyToken(idempotencyToken)
+		}); errDel != nil {
+			p.log.Error(
+				"releasing idempotency token",
+				slog.String("token", idempotencyToken),
+				slog.Any("error", errDel),
+			)
+		}
+		return "", false, err
+	}
+	err = p.withinTx(database.ReadWrite, func(tx *database.Tx) error {
+		return tx.SetIdempotencyToken(
+			idempotencyToken, version, p.idemWindow,
+		)
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("recording idempotency token: %w", err)
+	}
+	return version, false, nil
+}
+
+// ErrIdempotencyTokenPending is returned by AppendIdempotent while another
+// call with the same token is appending. Since the outcome of that call
+// is unknown, retry later to receive its version.
+var ErrIdempotencyTokenPending = errors.New("idempotency token pending")
+
+// Stats returns the current statistics of the producer.
+func (p *Producer) Stats() Stats {
+	p.statsLock.Lock()
+	defer p.statsLock.Unlock()
+	return p.stats
+}
+
+// VersionAt returns the version at which object was last modified.
+// An empty version is returned if object was stored without a version.
+// ErrObjectNotFound is returned if object doesn't exist.
+func (p *Producer) VersionAt(
+	ctx context.Context,
+	object string,
+) (version client.Version, err error) {
+	err = p.withinTx(database.ReadOnly, func(tx *database.Tx) error {
+		version, err = projection.VersionAt(ctx, tx, object)
+		return err
+	})
+	return
+}
+
+var ErrObjectNotFound = projection.ErrObjectNotFound
+
+// Audit returns at most limit of the most recent operations applied
+// to the projection starting with the most recent one.
+func (p *Producer) Audit(limit int) (entries []database.AuditEntry, err error) {
+	err = p.withinTx(database.ReadOnly, func(tx *database.Tx) error {
+		entries, err = projection.Audit(tx, limit)
+		return err
+	})
+	return
+}
+
+// updateLag updates the projection lag metric given the latest version.
+func (p *Producer) updateLag(latest client.Version) {
+	if p.metrics == nil {
+		return
+	}
+	var v client.Version
+	if err := p.withinTx(database.ReadOnly, func(tx *database.Tx) error {
+		var err error
+		v, err = tx.GetProjectionVersion()
+		return err
+	}); err != nil {
+		p.log.Error("reading projection version", slog.Any("error", err))
+		return
+	}
+	p.metrics.SetLag(latest, v)
+}
+
+// countAppended counts n appended events unless err is not nil
+// and returns err.
+func (p *Producer) countAppended(n int, err error) error {
+	if err == nil {
+		p.metrics.AddAppended(n)
 	}
+	return err
+}
 
-	db, err := database.Open(fDBDir, lDB)
-	if err != nil {
-		lApp.Fatalf("opening database: %s", err)
+// RetryPolicy defines how appends are retried when the projection
+// turns out to be outdated. The zero value retries immediately
+// and indefinitely.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of retries per append.
+	// The number of retries is unlimited if MaxAttempts is below 1.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry,
+	// which doubles with every further retry.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay between retries unless it's 0.
+	MaxDelay time.Duration
+
+	// Jitter randomizes each delay between 0 and the computed delay.
+	Jitter bool
+}
+
+// delay returns the delay before the given retry attempt starting at 1.
+func (r RetryPolicy) delay(attempt int) time.Duration {
+	d := r.BaseDelay
+	for i := 1; i < attempt && d > 0; i++ {
+		if r.MaxDelay > 0 && d >= r.MaxDelay || d > math.MaxInt64/2 {
+			break
+		}
+		d *= 2
 	}
-	defer db.Close()
+	if r.MaxDelay > 0 && d > r.MaxDelay {
+		d = r.MaxDelay
+	}
+	if r.Jitter && d > 0 {
+		d = time.Duration(rand.Int63n(int64(d) + 1))
+	}
+	return d
+}
 
-	httpc := client.NewHTTP(
-		fHost,
-		log.New(os.Stdout, "EVENTLOG CLIENT ERR:", log.LstdFlags),
-		nil, nil,
-	)
-	httpc.SetRetryInterval(time.Second)
-	ec := client.New(httpc)
+// SetObjectValidator sets fn to validate the names of objects
+// before they're written, for example to enforce naming conventions.
+// The error returned by fn is returned by the rejected operation.
+// It's safe to call while the producer is running.
+func (p *Producer) SetObjectValidator(fn func(object string) error) {
+	p.objectValidatorLock.Lock()
+	defer p.objectValidatorLock.Unlock()
+	p.objectValidator = fn
+}
 
-	p := &Producer{
-		db:  db,
-		c:   ec,
-		log: lApp,
+// validateObjects validates objects using the object validator
+// set by SetObjectValidator if any.
+func (p *Producer) validateObjects(objects ...string) error {
+	p.objectValidatorLock.Lock()
+	fn := p.objectValidator
+	p.objectValidatorLock.Unlock()
+	if fn == nil {
+		return nil
 	}
-	go func() {
-		if err := p.Run(context.Background()); err != nil {
-			if !errors.Is(err, context.Canceled) &&
-				!errors.Is(err, context.DeadlineExceeded) {
-				lApp.Fatalf("running producer: %s", err)
-			}
+	for _, o := range objects {
+		if err := fn(o); err != nil {
+			return err
 		}
-	}()
-
-	fmt.Println(`commands: `)
-	fmt.Println(`  put/take <num> <object>: puts or takes n objects`)
-	fmt.Println(`  exit:  exits the program`)
-	fmt.Println("---------------------")
-	if err := cli.ScanLines(func(ln string) error {
-		switch ln {
-		case "exit":
-			return cli.ErrAbortScan
-		default:
-			op, obj, quant, err := parseInput(ln)
-			if err != nil {
-				lApp.Printf("ERR: parsing input: %s\n", err)
-				return nil
-			}
+	}
+	return nil
+}
 
-			switch op {
-			case "put":
-				return p.Put(context.Background(), obj, quant)
-			case "take":
-				if err := p.Take(
-					context.Background(), obj, quant,
-				); err != nil {
-					if errors.Is(err, ErrInsuffQuant) {
-						lApp.Printf(
-							"ERR: can't take %d %s, insufficient number of %s",
-							quant, obj, obj,
-						)
-						return nil
-					}
-					return err
-				}
-			default:
-				panic("unsupported operation")
-			}
+// validateItemObjects validates the objects of the items of a bulk operation
+// using the object validator set by SetObjectValidator if any.
+func (p *Producer) validateItemObjects(items map[string]int64) error {
+	for _, o := range projection.SortedObjects(items) {
+		if err := p.validateObjects(o); err != nil {
+			return err
 		}
-		return nil
-	}); err != nil {
-		lApp.Fatalf("ERR CLI: %s", err)
 	}
+	return nil
 }
 
-// Producer is an event producer and an aggregate enforcing invariants.
-// It stores its projection of the current state of the world in a database.
-type Producer struct {
-	db  *database.DB
-	c   *client.Client
-	log *log.Logger
+// SetRetryPolicy sets the policy appends are retried with.
+// It's safe to call while the producer is running.
+func (p *Producer) SetRetryPolicy(r RetryPolicy) {
+	p.retryPolicyLock.Lock()
+	defer p.retryPolicyLock.Unlock()
+	p.retryPolicy = r
 }
 
-// Run synchronizes the database and begins listening for new events
-// as long as ctx is not canceled.
-func (p *Producer) Run(ctx context.Context) (err error) {
-	if _, err := p.Sync(context.Background(), nil); err != nil {
-		return fmt.Errorf("synchronizing: %w", err)
+// assumedVersion returns the projection version read from t to be passed
+// to TryAppend and TryAppendMulti as the assumed version of the log.
+// The version of an empty log is assumed if no events were applied yet,
+// so that appending to a non-empty log fails with a version mismatch
+// and synchronizes instead of failing with client.ErrInvalidVersion.
+func assumedVersion(t *database.Tx) (client.Version, error) {
+	v, err := t.GetProjectionVersion()
+	if v == "" && err == nil {
+		v = "0"
 	}
+	return v, err
+}
 
-	p.log.Printf("listening for updates")
-	return p.c.Listen(ctx, func(v client.Version) {
-		p.log.Printf("update received, log version: %s", string(v))
-		if _, err = p.Sync(ctx, nil); err != nil {
-			err = fmt.Errorf("synchronizing: %w", err)
-			return
+// retrySync returns the sync function passed to TryAppend and
+// TryAppendMulti, which synchronizes the projection within t after
+// the delay defined by the retry policy and counts the retry.
+// ErrMaxRetriesExceeded is returned once the retries are exhausted.
+func (p *Producer) retrySync(
+	ctx context.Context,
+	t *database.Tx,
+) func() (client.Version, error) {
+	p.retryPolicyLock.Lock()
+	policy := p.retryPolicy
+	p.retryPolicyLock.Unlock()
+
+	attempt := 0
+	return func() (client.Version, error) {
+		attempt++
+		if policy.MaxAttempts > 0 && attempt > policy.MaxAttempts {
+			return "", ErrMaxRetriesExceeded
+		}
+		p.metrics.IncAppendRetries()
+		if d := policy.delay(attempt); d > 0 {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(d):
+			}
 		}
+		return p.Sync(ctx, t)
+	}
+}
+
+var ErrMaxRetriesExceeded = errors.New("maximum number of retries exceeded")
+
+// withinTx is similar to database.DB.WithinTx but also accumulates
+// the statistics of committed transactions.
+func (p *Producer) withinTx(
+	tt database.TxType,
+	fn func(*database.Tx) error,
+) error {
+	return p.withinTxContext(context.Background(), tt, fn)
+}
+
+// withinTxContext is similar to withinTx but cancels all scans performed
+// within the transaction once ctx is canceled
+// (see database.DB.WithinTxContext).
+func (p *Producer) withinTxContext(
+	ctx context.Context,
+	tt database.TxType,
+	fn func(*database.Tx) error,
+) error {
+	return p.db.WithinTxContext(ctx, tt, func(tx *database.Tx) error {
+		tx.OnCommit(func() {
+			s, _ := tx.GetStats()
+			p.statsLock.Lock()
+			defer p.statsLock.Unlock()
+			p.stats.Transactions++
+			p.stats.TxStats = p.stats.TxStats.Add(s)
+		})
+		return fn(tx)
 	})
 }
 
-// Put puts objects of the given type onto the pile.
-func (p *Producer) Put(
+// TakeOrQueue is similar to Take but calls queueFn instead of returning
+// ErrInsuffQuant if there aren't enough instances stored, leaving the
+// eventual fulfillment of the request to whatever queueFn enqueues.
+func (p *Producer) TakeOrQueue(
 	ctx context.Context,
 	object string,
 	quantity int64,
+	queueFn func() error,
 ) error {
-	if err := ValidateInput(object, quantity); err != nil {
-		return err
+	err := p.Take(ctx, object, quantity)
+	if errors.Is(err, ErrInsuffQuant) {
+		p.log.Info(
+			"insufficient quantity, queueing take",
+			slog.String("object", object), slog.Int64("quantity", quantity),
+		)
+		return queueFn()
 	}
+	return err
+}
 
-	// Put operations don't require invariant checking
-	ev, err := event.Encode(event.Event{
-		Operation: "put",
-		Object:    object,
-		Quantity:  quantity,
+// Replay clears the projection and re-applies all events of the log,
+// which is necessary after the way events are applied changed.
+// No events are appended and no audit entries are recorded.
+// To avoid exceeding the transaction size limit the events are replayed
+// in transactions of at most the batch size set by WithReplayBatchSize,
+// so operations running concurrently observe a partially replayed
+// projection. If Replay fails, the following synchronization
+// completes the replay.
+func (p *Producer) Replay(ctx context.Context) error {
+
+	p.log.Info("replaying event log")
+	err := p.withinTxContext(ctx, database.ReadWrite, func(
+		tx *database.Tx,
+	) error {
+		return tx.SetProjectionVersionBatch("", nil)
 	})
 	if err != nil {
-		return err
+		return fmt.Errorf("clearing projection: %w", err)
+	}
+	for total := 0; ; {
+		var n int
+		err := p.withinTxContext(ctx, database.ReadWrite, func(
+			tx *database.Tx,
+		) (err error) {
+			_, n, err = p.syncBatch(ctx, tx, p.replayBatchSize, false)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("synchronizing: %w", err)
+		}
+		total += n
+		p.log.Info("replayed", slog.Int("events", total))
+		if p.replayBatchSize < 1 || n < p.replayBatchSize {
+			return nil
+		}
 	}
-
-	_, _, _, err = p.c.Append(ctx, ev)
-	return err
 }
 
-// Take takes objects of the given type from the pile.
-// ErrInsuffQuant is returned if there aren't enough instances stored.
-func (p *Producer) Take(
-	ctx context.Context,
-	object string,
-	quantity int64,
-) error {
-	if err := ValidateInput(object, quantity); err != nil {
+// MergeWithServer replays the entire event log into a fresh in-memory
+// database, compares the replay with the local projection and appends
+// an "adjust" event for every object whose quantity differs, correcting
+// the local projection and all consumers that diverged the same way
+// through the event log. All discrepancies are logged.
+// The corrections become part of the log, so MergeWithServer should only
+// be used once projections diverged from the log, for example after events
+// were applied incorrectly. ErrMergeConflict is returned if the log
+// was appended to while merging.
+func (p *Producer) MergeWithServer(ctx context.Context) error {
+
+	if _, err := p.Sync(ctx, nil); err != nil {
+		return fmt.Errorf("synchronizing: %w", err)
+	}
+
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tmp, err := database.Open("", discard)
+	if err != nil {
+		return fmt.Errorf("opening replay database: %w", err)
+	}
+	defer tmp.Close()
+	replay := NewProducer(tmp, p.c, discard)
+	if _, err := replay.Sync(ctx, nil); err != nil {
+		return fmt.Errorf("replaying: %w", err)
+	}
+
+	var replayVersion client.Version
+	var replayed map[string]int64
+	if err := tmp.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		if replayVersion, err = tx.GetProjectionVersion(); err != nil {
+			return err
+		}
+		replayed, err = tx.GetAll()
 		return err
+	}); err != nil {
+		return fmt.Errorf("reading replay: %w", err)
 	}
-	return p.db.WithinTx(database.ReadWrite, func(t *database.Tx) error {
-		// Get the current version projected by the database
-		// and try to append a Take event onto it.
-		v, err := t.GetProjectionVersion()
-		if err != nil {
-			return fmt.Errorf("reading projection version: %w", err)
+
+	var localVersion client.Version
+	var local map[string]int64
+	if err := p.withinTx(database.ReadOnly, func(tx *database.Tx) error {
+		var err error
+		if localVersion, err = tx.GetProjectionVersion(); err != nil {
+			return err
 		}
-		_, _, _, err = p.c.TryAppend(
-			ctx, v,
-			// Transaction will either return ErrInsuffQuant if there aren't
-			// enough instances of the requested object stored in the database
-			// or the Take event that's written to the eventlog.
-			func() (client.EventData, error) {
-				// Make sure there's enough instances of the object stored!
-				q, err := t.GetQuantity(object)
-				if err != nil {
-					return eventlog.EventData{}, err
-				}
-				if q-quantity < 0 {
-					return eventlog.EventData{}, ErrInsuffQuant
-				}
+		local, err = tx.GetAll()
+		return err
+	}); err != nil {
+		return fmt.Errorf("reading projection: %w", err)
+	}
+	if localVersion != replayVersion {
+		return fmt.Errorf(
+			"%w: local version %q, replayed version %q",
+			ErrMergeConflict, localVersion, replayVersion,
+		)
+	}
 
-				ev, err := event.Encode(event.Event{
-					Operation: "take",
-					Object:    object,
-					Quantity:  quantity,
-				})
-				return ev, err
-			},
-			// Sync will be called if client.AppendCheck fails due to a
-			// client.ErrMismatchingVersions error, which indicates
-			// that the projection of this service is outdated and must
-			// first be updated to make sure no invariants are accepted.
-			func() (client.Version, error) { return p.Sync(ctx, t) },
+	deltas := map[string]int64{}
+	for o, q := range local {
+		deltas[o] -= q
+	}
+	for o, q := range replayed {
+		deltas[o] += q
+	}
+	var corrections []client.EventData
+	for _, o := range projection.SortedObjects(deltas) {
+		delta := deltas[o]
+		if delta == 0 {
+			continue
+		}
+		p.log.Info(
+			"merge: discrepancy",
+			slog.String("object", o),
+			slog.Int64("local", local[o]),
+			slog.Int64("replayed", replayed[o]),
 		)
-		return err
-	})
+		ev, err := event.Encode(event.Event{
+			Operation: "adjust",
+			Object:    o,
+			Quantity:  delta,
+		})
+		if err != nil {
+			return err
+		}
+		corrections = append(corrections, ev)
+	}
+	if len(corrections) < 1 {
+		p.log.Info("merge: no discrepancies")
+		return nil
+	}
+
+	assumedVersion := replayVersion
+	if assumedVersion == "" {
+		// The log is empty
+		if assumedVersion, err = p.c.Version(ctx); err != nil {
+			return err
+		}
+	}
+	_, _, _, err = p.c.AppendCheckMulti(ctx, assumedVersion, corrections...)
+	if errors.Is(err, client.ErrMismatchingVersions) {
+		return fmt.Errorf("%w: %v", ErrMergeConflict, err)
+	}
+	if err := p.countAppended(len(corrections), err); err != nil {
+		return fmt.Errorf("appending corrections: %w", err)
+	}
+	p.log.Info("merge: corrected", slog.Int("objects", len(corrections)))
+	if _, err := p.Sync(ctx, nil); err != nil {
+		return fmt.Errorf("synchronizing: %w", err)
+	}
+	return nil
 }
 
-var ErrInsuffQuant = errors.New("insufficient quantity stored")
+var ErrMergeConflict = errors.New("event log appended to during merge")
 
 // Sync synchronizes the database against the eventlog applying any
 // relevant event. If tx == nil then the synchronization will be executed
 // within a new transaction. Sync returns the latestVersion it synchronized to.
+// Concurrent calls with tx == nil share a single in-flight synchronization
+// and receive the same result. The shared synchronization isn't canceled
+// when the context of any caller is, but each caller returns ctx.Err()
+// as soon as its own ctx is canceled.
 func (p *Producer) Sync(
 	ctx context.Context,
 	tx *database.Tx,
 ) (latestVersion client.Version, err error) {
-	p.log.Printf("synchronizing")
+	ctx, span := otel.Tracer().Start(ctx, "Producer.Sync")
+	defer func() {
+		span.SetAttributes(attribute.String("version", latestVersion))
+		otel.End(span, err)
+	}()
+
+	p.log.Info("synchronizing")
 	if tx != nil {
 		return p.sync(ctx, tx)
 	}
-	err = p.db.WithinTx(database.ReadWrite, func(tx *database.Tx) error {
-		latestVersion, err = p.sync(ctx, tx)
-		return err
+	syncCtx := context.WithoutCancel(ctx)
+	ch := p.syncGroup.DoChan("sync", func() (interface{}, error) {
+		var latestVersion client.Version
+		err := p.withinTxContext(syncCtx, database.ReadWrite, func(
+			tx *database.Tx,
+		) error {
+			var err error
+			latestVersion, err = p.sync(syncCtx, tx)
+			return err
+		})
+		return latestVersion, err
 	})
-	return
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case r := <-ch:
+		if r.Shared {
+			p.log.Debug("shared in-flight synchronization")
+		}
+		return r.Val.(client.Version), r.Err
+	}
 }
 
 func (p *Producer) sync(
 	ctx context.Context,
 	tx *database.Tx,
 ) (latestVersion client.Version, err error) {
-	p.log.Printf("synchronizing")
-	v, err := tx.GetProjectionVersion()
+	latestVersion, _, err = p.syncBatch(ctx, tx, 0, true)
+	return latestVersion, err
+}
+
+// syncBatch applies at most limit events following the projection version
+// within tx and returns the number of applied events. limit < 1 applies
+// all events. No audit entries are recorded if audit is false.
+func (p *Producer) syncBatch(
+	ctx context.Context,
+	tx *database.Tx,
+	limit int,
+	audit bool,
+) (latestVersion client.Version, applied int, err error) {
+	p.log.Info("synchronizing")
+	start := time.Now()
+	defer func() { p.metrics.ObserveSync(time.Since(start)) }()
+	v, err := tx.GetVersionOrZero()
 	if err != nil {
-		return "", fmt.Errorf("reading projection version: %w", err)
+		return "", 0, fmt.Errorf("reading projection version: %w", err)
 	}
 
 	sv := v
 	if sv == "" {
 		if sv, err = p.c.VersionInitial(ctx); err != nil {
-			return "", err
+			return "", 0, err
 		}
-		p.log.Printf("starting at initial version")
+		p.log.Info("starting at initial version")
 	} else {
-		p.log.Printf("current projection version: %s", v)
+		p.log.Info("current projection version", slog.String("version", v))
 	}
 
 	if sv == "0" {
 		// Log is empty
-		p.log.Printf("event log is empty")
-		return sv, nil
+		p.log.Info("event log is empty")
+		return sv, 0, nil
 	}
 
 	err = p.c.Scan(ctx, sv, false, func(e client.Event) error {
-		p.log.Printf(
-			"scanning %s %s %s",
-			e.Version, string(e.Label), string(e.PayloadJSON),
+		p.log.Debug(
+			"scanning",
+			slog.String("version", e.Version),
+			slog.String("label", string(e.Label)),
+			slog.String("payload", string(e.PayloadJSON)),
 		)
 		if v == e.Version {
 			// Ignore the current version
-			p.log.Printf("ignoring %s / %s", v, e.Version)
+			p.log.Debug("ignoring", slog.String("version", e.Version))
 			return nil
 		}
-		if err := p.apply(tx, e); err != nil {
+		if err := p.apply(tx, e, audit); err != nil {
 			return err
 		}
 		latestVersion = e.Version
+		if applied++; limit > 0 && applied >= limit {
+			return database.ErrAbortScan
+		}
 		return nil
 	})
+	if errors.Is(err, database.ErrAbortScan) {
+		err = nil
+	}
 	return
 }
 
-// apply applies e to the database within the given transaction.
-func (p *Producer) apply(tx *database.Tx, e client.Event) (err error) {
+// apply applies e to the database within the given transaction
+// and calls the apply hook. An audit entry is recorded if audit is true.
+func (p *Producer) apply(
+	tx *database.Tx,
+	e client.Event,
+	audit bool,
+) error {
+	if err := p.applyEvent(tx, e, audit); err != nil {
+		return err
+	}
+	if p.applyHook != nil {
+		return p.applyHook(tx, e)
+	}
+	return nil
+}
+
+func (p *Producer) applyEvent(
+	tx *database.Tx,
+	e client.Event,
+	audit bool,
+) (err error) {
 	defer func() {
 		if err != nil {
 			return
@@ -282,38 +2020,178 @@ func (p *Producer) apply(tx *database.Tx, e client.Event) (err error) {
 		if err = tx.SetProjectionVersion(e.Version); err != nil {
 			return
 		}
-		p.log.Printf("update projection version: %s", e.Version)
+		p.log.Debug(
+			"update projection version", slog.String("version", e.Version),
+		)
 	}()
 
+	p.metrics.AddApplied(1)
+
+	var unknown event.UnknownEventError
 	event, err := event.Decode(e)
 	if err != nil {
+		if errors.As(err, &unknown) {
+			// Events emitted by newer producers can't affect invariants
+			// checked by this version, skip them advancing the version
+			p.log.Warn(
+				"skipping unknown event",
+				slog.String("version", e.Version),
+				slog.String("label", string(unknown.Label)),
+			)
+			return nil
+		}
 		return fmt.Errorf("decoding event: %w", err)
 	}
+	if event.IdempotencyKey != "" {
+		dup, err := tx.RecordIdempotencyKey(
+			event.IdempotencyKey, e.Version, event.RecordedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("recording idempotency key: %w", err)
+		}
+		if dup {
+			p.log.Debug(
+				"skipping duplicate",
+				slog.String("version", e.Version),
+				slog.String("idempotency_key", event.IdempotencyKey),
+			)
+			return nil
+		}
+	}
+	if audit && event.Operation != "checkpoint" {
+		if err := tx.SetAuditEntry(database.AuditEntry{
+			Version:   e.Version,
+			Operation: event.Operation,
+			Object:    event.Object,
+			Quantity:  event.Quantity,
+			AppliedAt: time.Now(),
+		}); err != nil {
+			return fmt.Errorf("recording audit entry: %w", err)
+		}
+	}
+	switch event.Operation {
+	case "expire":
+		// Expiry is enforced by the consumer
+		return nil
+	case "checkpoint":
+		return nil
+	}
+
+	p.log.Debug(
+		"applying",
+		slog.String("version", e.Version),
+		slog.Time("recorded_at", event.RecordedAt),
+	)
+
+	switch event.Operation {
+	case "bulk-put", "bulk-take":
+		for _, o := range projection.SortedObjects(event.Items) {
+			delta := event.Items[o]
+			if event.Operation == "bulk-take" {
+				delta = -delta
+			}
+			if err := p.applyDelta(tx, e, event, o, delta); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "transfer":
+		err := p.applyDelta(tx, e, event, event.Source, -event.Quantity)
+		if err != nil {
+			return err
+		}
+		return p.applyDelta(tx, e, event, event.Destination, event.Quantity)
+	case "reserve":
+		return projection.ApplyReserved(
+			p.log, tx,
+			event.ReservationID, event.Object, event.Quantity,
+		)
+	case "release":
+		err := projection.ApplyReserved(
+			p.log, tx,
+			event.ReservationID, event.Object, -event.Quantity,
+		)
+		if err != nil || !event.Take {
+			return err
+		}
+		return p.applyDelta(tx, e, event, event.Object, -event.Quantity)
+	case "take":
+		return p.applyDelta(tx, e, event, event.Object, -event.Quantity)
+	case "set":
+		q, err := tx.GetQuantity(event.Object)
+		if err != nil {
+			return err
+		}
+		return p.applyDelta(tx, e, event, event.Object, event.Quantity-q)
+	}
+	return p.applyDelta(tx, e, event, event.Object, event.Quantity)
+}
 
-	previousQuantity, err := tx.GetQuantity(event.Object)
+// applyDelta adds delta to the quantity of object.
+func (p *Producer) applyDelta(
+	tx *database.Tx,
+	e client.Event,
+	ev event.Event,
+	object string,
+	delta int64,
+) error {
+	previousQuantity, err := tx.GetQuantity(object)
 	if err != nil {
 		return err
 	}
-	var newQuantity int64
-	switch string(e.Label) {
-	case "take":
-		newQuantity = previousQuantity - int64(event.Quantity)
-	case "put":
-		newQuantity = previousQuantity + int64(event.Quantity)
+	if err := projection.RecoverEntry(
+		p.log, tx, object, previousQuantity,
+	); err != nil {
+		return fmt.Errorf("recovering entry: %w", err)
 	}
+	newQuantity := previousQuantity + delta
 
-	p.log.Printf("applying version: %s", e.Version)
+	o := Observation{
+		Object:     object,
+		Version:    e.Version,
+		Timestamp:  e.Time,
+		RecordedAt: ev.RecordedAt,
+	}
+	if newQuantity > 0 {
+		o.Quantity = newQuantity
+	}
+	tx.OnCommit(func() { p.publish(o) })
 
 	if newQuantity < 1 {
-		p.log.Printf("deleting object: %q", event.Object)
-		return tx.Delete(event.Object)
+		p.log.Debug("deleting object", slog.String("object", object))
+		return tx.Delete(object)
+	}
+	if limit, ok := p.maxQuantity[object]; ok && newQuantity > limit {
+		// The event is already logged and must be applied regardless
+		p.log.Warn(
+			"quantity exceeds cap",
+			slog.String("object", object),
+			slog.Int64("quantity", newQuantity),
+			slog.Int64("max", limit),
+		)
 	}
 
-	p.log.Printf(
-		"%s object %s: %d -> %d",
-		e.Label, event.Object, previousQuantity, newQuantity,
+	p.log.Debug(
+		"updating object",
+		slog.String("label", string(e.Label)),
+		slog.String("object", object),
+		slog.Int64("from", previousQuantity),
+		slog.Int64("to", newQuantity),
 	)
-	return tx.Set(event.Object, newQuantity)
+	return tx.SetWithVersion(object, newQuantity, e.Version)
+}
+
+// validateItems validates the items of a bulk operation.
+func validateItems(items map[string]int64) error {
+	if len(items) < 1 {
+		return errors.New("no items")
+	}
+	for object, quantity := range items {
+		if err := ValidateInput(object, quantity); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func ValidateInput(object string, quantity int64) error {
@@ -326,33 +2204,28 @@ func ValidateInput(object string, quantity int64) error {
 	return nil
 }
 
-const inputRegex = `^(\w+)\s+(.+)\s+(\w+)$`
-
-var regex = regexp.MustCompile(inputRegex)
-
-func parseInput(in string) (op, object string, quantity int64, err error) {
-	m := regex.FindAllStringSubmatch(in, -1)
-	if len(m) != 1 || len(m[0]) != 4 {
-		err = errors.New(
-			`syntax error, input must match: ` + inputRegex,
-		)
-		return
+// ValidateAdjustment validates the input of an adjustment,
+// which unlike other operations allows negative quantities.
+func ValidateAdjustment(object string, delta int64) error {
+	if object == "" {
+		return fmt.Errorf("invalid object: %q", object)
 	}
-
-	switch m[0][1] {
-	case "put", "take":
-	default:
-		err = fmt.Errorf(
-			"invalid operation %q, use either \"put\" or \"take\"", m[0][1],
-		)
-		return
+	if delta == 0 {
+		return fmt.Errorf("invalid delta: %d", delta)
 	}
+	return nil
+}
 
-	n, err := strconv.ParseInt(m[0][2], 10, 32)
-	if err != nil {
-		err = fmt.Errorf("parsing number: %w", err)
-		return
+// ValidateTransfer validates the input of a transfer.
+func ValidateTransfer(source, destination string, quantity int64) error {
+	if err := ValidateInput(source, quantity); err != nil {
+		return err
 	}
-
-	return m[0][1], m[0][3], n, nil
+	if err := ValidateInput(destination, quantity); err != nil {
+		return err
+	}
+	if source == destination {
+		return ErrSameObject
+	}
+	return nil
 }
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/romshark/eventlog-example/database"
+	"github.com/romshark/eventlog-example/event"
+
+	"github.com/romshark/eventlog/client"
+	"github.com/romshark/eventlog/eventlog"
+	"github.com/romshark/eventlog/eventlog/inmem"
+)
+
+// newTestProducer returns a synchronized producer appending to
+// an in-memory event log and projecting into an in-memory database.
+func newTestProducer(t *testing.T, opts ...Option) (*Producer, *client.Client) {
+	t.Helper()
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db, err := database.Open("", l)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	c := client.New(client.NewInmem(eventlog.New(inmem.New(nil))))
+	p := NewProducer(db, c, l, opts...)
+	if _, err := p.Sync(context.Background(), nil); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	return p, c
+}
+
+// quantity synchronizes p and returns the stored quantity of object.
+func quantity(t *testing.T, p *Producer, object string) (q int64) {
+	t.Helper()
+	if _, err := p.Sync(context.Background(), nil); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	err := p.db.WithinTx(database.ReadOnly, func(tx *database.Tx) (err error) {
+		q, err = tx.GetQuantity(object)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("reading %q: %v", object, err)
+	}
+	return q
+}
+
+func TestPutExceedsCap(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newTestProducer(t, WithMaxQuantity("apple", 10))
+
+	for i := 0; i < 3; i++ {
+		if err := p.Put(ctx, "apple", 3); err != nil {
+			t.Fatalf("put %d: %v", i, err)
+		}
+	}
+	if err := p.Put(ctx, "apple", 2); !errors.Is(err, ErrExceedsCap) {
+		t.Fatalf("expected ErrExceedsCap, got %v", err)
+	}
+	if err := p.Put(ctx, "apple", 1); err != nil {
+		t.Fatalf("put up to the cap: %v", err)
+	}
+	if err := p.Put(ctx, "apple", 1); !errors.Is(err, ErrExceedsCap) {
+		t.Fatalf("expected ErrExceedsCap, got %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 10 {
+		t.Fatalf("expected 10, got %d", q)
+	}
+
+	// Uncapped objects are unaffected
+	if err := p.Put(ctx, "pear", 100); err != nil {
+		t.Fatalf("put pear: %v", err)
+	}
+}
+
+func TestTransferWithInvariantExceedsCap(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newTestProducer(t, WithMaxQuantity("pear", 5))
+
+	if err := p.Put(ctx, "apple", 10); err != nil {
+		t.Fatalf("put apple: %v", err)
+	}
+	if err := p.Put(ctx, "pear", 4); err != nil {
+		t.Fatalf("put pear: %v", err)
+	}
+	noCheck := func(fromQ, toQ int64) error { return nil }
+	err := p.TransferWithInvariant(ctx, "apple", "pear", 2, noCheck)
+	if !errors.Is(err, ErrExceedsCap) {
+		t.Fatalf("expected ErrExceedsCap, got %v", err)
+	}
+	if err := p.TransferWithInvariant(
+		ctx, "apple", "pear", 1, noCheck,
+	); err != nil {
+		t.Fatalf("transferring up to the cap: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 9 {
+		t.Errorf("expected 9 apples, got %d", q)
+	}
+	if q := quantity(t, p, "pear"); q != 5 {
+		t.Errorf("expected 5 pears, got %d", q)
+	}
+}
+
+func TestReplayAppliesChangedLogic(t *testing.T) {
+	ctx := context.Background()
+	p, c := newTestProducer(t)
+
+	if err := p.Put(ctx, "apple", 3); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := p.Put(ctx, "apple", 4); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 7 {
+		t.Fatalf("expected 7, got %d", q)
+	}
+	if err := p.Take(ctx, "apple", 2); err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 5 {
+		t.Fatalf("expected 5, got %d", q)
+	}
+	auditBefore, err := p.Audit(100)
+	if err != nil {
+		t.Fatalf("reading audit: %v", err)
+	}
+	versionBefore, err := c.Version(ctx)
+	if err != nil {
+		t.Fatalf("reading log version: %v", err)
+	}
+
+	// Puts now count twice
+	doublePuts := func(tx *database.Tx, e client.Event) error {
+		ev, err := event.Decode(e)
+		if err != nil || ev.Operation != "put" {
+			return err
+		}
+		q, err := tx.GetQuantity(ev.Object)
+		if err != nil {
+			return err
+		}
+		return tx.Set(ev.Object, q+ev.Quantity)
+	}
+	replay := NewProducer(
+		p.db, c, p.log,
+		WithApplyHook(doublePuts),
+		WithReplayBatchSize(2),
+	)
+	if err := replay.Replay(ctx); err != nil {
+		t.Fatalf("replaying: %v", err)
+	}
+
+	if q := quantity(t, replay, "apple"); q != 12 {
+		t.Fatalf("expected 12, got %d", q)
+	}
+	if v, err := c.Version(ctx); err != nil {
+		t.Fatalf("reading log version: %v", err)
+	} else if v != versionBefore {
+		t.Fatalf("replay appended events: %s != %s", v, versionBefore)
+	}
+	auditAfter, err := replay.Audit(100)
+	if err != nil {
+		t.Fatalf("reading audit: %v", err)
+	}
+	if len(auditAfter) != len(auditBefore) {
+		t.Fatalf("replay recorded audit entries: %d != %d",
+			len(auditAfter), len(auditBefore))
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	p, _ := newTestProducer(t, WithOperationTimeout(time.Minute))
+
+	type key struct{}
+	baseCtx, cancelBase := context.WithCancel(
+		context.WithValue(context.Background(), key{}, "base"),
+	)
+	defer cancelBase()
+	b := p.WithContext(baseCtx)
+
+	ctx, cancel := b.opContext()
+	defer cancel()
+	if v := ctx.Value(key{}); v != "base" {
+		t.Fatalf("expected operation context derived from base, got %v", v)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		t.Fatalf("expected the operation timeout to be applied")
+	}
+
+	if err := b.Put("apple", 3); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 3 {
+		t.Fatalf("expected 3, got %d", q)
+	}
+	if err := b.Take("apple", 1); err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 2 {
+		t.Fatalf("expected 2, got %d", q)
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- b.Run() }()
+	cancelBase()
+	select {
+	case err := <-errs:
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Fatalf("running: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run didn't stop after the base context was canceled")
+	}
+}
+
+func TestObserveConcurrentObservers(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newTestProducer(t)
+
+	streams := make([]ObservationStream, 2)
+	for i := range streams {
+		s, err := p.Observe(ctx, "apple")
+		if err != nil {
+			t.Fatalf("observing: %v", err)
+		}
+		defer s.Close()
+		streams[i] = s
+	}
+
+	if err := p.Put(ctx, "apple", 3); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 3 {
+		t.Fatalf("expected 3, got %d", q)
+	}
+
+	var wg sync.WaitGroup
+	for i, s := range streams {
+		wg.Add(1)
+		go func(i int, s ObservationStream) {
+			defer wg.Done()
+			select {
+			case o := <-s.C:
+				if o.Object != "apple" || o.Quantity != 3 {
+					t.Errorf("observer %d: unexpected observation %#v", i, o)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("observer %d: no observation received", i)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	// Closed streams no longer receive observations
+	streams[0].Close()
+	if _, ok := <-streams[0].C; ok {
+		t.Fatalf("expected the closed stream's channel to be closed")
+	}
+}
+
+func TestTakeOrQueue(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newTestProducer(t)
+
+	if err := p.Put(ctx, "apple", 2); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	quantity(t, p, "apple")
+
+	queued := 0
+	queue := func() error { queued++; return nil }
+	if err := p.TakeOrQueue(ctx, "apple", 3, queue); err != nil {
+		t.Fatalf("taking insufficient quantity: %v", err)
+	}
+	if queued != 1 {
+		t.Fatalf("expected queueFn to be called once, got %d", queued)
+	}
+	if q := quantity(t, p, "apple"); q != 2 {
+		t.Fatalf("expected 2, got %d", q)
+	}
+
+	if err := p.TakeOrQueue(ctx, "apple", 2, queue); err != nil {
+		t.Fatalf("taking sufficient quantity: %v", err)
+	}
+	if queued != 1 {
+		t.Fatalf("expected queueFn not to be called, got %d calls", queued)
+	}
+	if q := quantity(t, p, "apple"); q != 0 {
+		t.Fatalf("expected 0, got %d", q)
+	}
+}
+
+func TestConcurrentSyncsCollapse(t *testing.T) {
+	ctx := context.Background()
+	p, c := newTestProducer(t)
+	if err := p.Put(ctx, "apple", 3); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	// The first application blocks until all syncs were started
+	var applied atomic.Int32
+	entered, release := make(chan struct{}), make(chan struct{})
+	hook := func(tx *database.Tx, e client.Event) error {
+		if applied.Add(1) == 1 {
+			close(entered)
+			<-release
+		}
+		return nil
+	}
+	s := NewProducer(p.db, c, p.log, WithApplyHook(hook))
+
+	const syncs = 10
+	errs := make(chan error, syncs)
+	syncFn := func() {
+		_, err := s.Sync(ctx, nil)
+		errs <- err
+	}
+	go syncFn()
+	<-entered
+	for i := 1; i < syncs; i++ {
+		go syncFn()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < syncs; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("syncing: %v", err)
+		}
+	}
+
+	if n := applied.Load(); n != 1 {
+		t.Fatalf("expected the event to be applied once, got %d", n)
+	}
+	if q := quantity(t, s, "apple"); q != 3 {
+		t.Fatalf("expected 3, got %d", q)
+	}
+}
+
+func TestSyncCallerCancel(t *testing.T) {
+	ctx := context.Background()
+	p, c := newTestProducer(t)
+	if err := p.Put(ctx, "apple", 3); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	hook := func(tx *database.Tx, e client.Event) error {
+		once.Do(func() {
+			close(entered)
+			<-release
+		})
+		return nil
+	}
+	s := NewProducer(p.db, c, p.log, WithApplyHook(hook))
+
+	// Canceling the caller that started the synchronization
+	// must neither cancel it for the other callers nor block the caller
+	ctx1, cancel := context.WithCancel(ctx)
+	errs1 := make(chan error, 1)
+	go func() {
+		_, err := s.Sync(ctx1, nil)
+		errs1 <- err
+	}()
+	<-entered
+	errs2 := make(chan error, 1)
+	go func() {
+		_, err := s.Sync(ctx, nil)
+		errs2 <- err
+	}()
+	cancel()
+	if err := <-errs1; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-errs2; err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if q := quantity(t, s, "apple"); q != 3 {
+		t.Fatalf("expected 3, got %d", q)
+	}
+}
+
+func TestBulkTake(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		take   map[string]int64
+		expect map[string]int64
+		err    error
+	}{
+		{
+			name:   "all sufficient",
+			take:   map[string]int64{"apple": 2, "pear": 1},
+			expect: map[string]int64{"apple": 3, "pear": 2},
+		},
+		{
+			name:   "all available",
+			take:   map[string]int64{"apple": 5, "pear": 3},
+			expect: map[string]int64{"apple": 0, "pear": 0},
+		},
+		{
+			name:   "one insufficient",
+			take:   map[string]int64{"apple": 2, "pear": 4},
+			expect: map[string]int64{"apple": 5, "pear": 3},
+			err:    ErrInsuffQuant,
+		},
+		{
+			name:   "one not stored",
+			take:   map[string]int64{"apple": 1, "kiwi": 1},
+			expect: map[string]int64{"apple": 5, "pear": 3},
+			err:    ErrInsuffQuant,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, _ := newTestProducer(t)
+			if err := p.BulkPut(ctx, map[string]int64{
+				"apple": 5, "pear": 3,
+			}); err != nil {
+				t.Fatalf("bulk put: %v", err)
+			}
+			quantity(t, p, "apple")
+
+			err := p.BulkTake(ctx, tt.take)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("bulk take: %v", err)
+			}
+			for object, expect := range tt.expect {
+				if q := quantity(t, p, object); q != expect {
+					t.Errorf("expected %d %s, got %d", expect, object, q)
+				}
+			}
+		})
+	}
+}
+
+func TestReserveRelease(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newTestProducer(t)
+	if err := p.Put(ctx, "apple", 5); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	quantity(t, p, "apple")
+
+	if err := p.Reserve(ctx, "apple", 3, "r1"); err != nil {
+		t.Fatalf("reserving: %v", err)
+	}
+	quantity(t, p, "apple")
+	if err := p.Reserve(ctx, "apple", 1, "r1"); !errors.Is(
+		err, ErrReservationExists,
+	) {
+		t.Fatalf("expected ErrReservationExists, got %v", err)
+	}
+	if err := p.Reserve(ctx, "apple", 3, "r2"); !errors.Is(
+		err, ErrInsuffQuant,
+	) {
+		t.Fatalf("expected ErrInsuffQuant, got %v", err)
+	}
+
+	// Only the unreserved quantity can be taken
+	if err := p.Take(ctx, "apple", 3); !errors.Is(err, ErrInsuffQuant) {
+		t.Fatalf("expected ErrInsuffQuant, got %v", err)
+	}
+	if err := p.Take(ctx, "apple", 2); err != nil {
+		t.Fatalf("taking the unreserved quantity: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 3 {
+		t.Fatalf("expected 3, got %d", q)
+	}
+
+	if err := p.Release(ctx, "apple", 4, "r1", false); !errors.Is(
+		err, ErrInsuffReserved,
+	) {
+		t.Fatalf("expected ErrInsuffReserved, got %v", err)
+	}
+	if err := p.Release(ctx, "apple", 1, "r1", true); err != nil {
+		t.Fatalf("releasing into a take: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 2 {
+		t.Fatalf("expected 2, got %d", q)
+	}
+	if err := p.Release(ctx, "apple", 2, "r1", false); err != nil {
+		t.Fatalf("canceling: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 2 {
+		t.Fatalf("expected 2, got %d", q)
+	}
+	if err := p.Release(ctx, "apple", 1, "r1", false); !errors.Is(
+		err, ErrUnknownReservation,
+	) {
+		t.Fatalf("expected ErrUnknownReservation, got %v", err)
+	}
+
+	// The released quantity is available again
+	if err := p.Take(ctx, "apple", 2); err != nil {
+		t.Fatalf("taking the released quantity: %v", err)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	r := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, expect := range map[int]time.Duration{
+		1:  10 * time.Millisecond,
+		2:  20 * time.Millisecond,
+		3:  40 * time.Millisecond,
+		7:  640 * time.Millisecond,
+		8:  time.Second,
+		64: time.Second,
+	} {
+		if d := r.delay(attempt); d != expect {
+			t.Errorf("attempt %d: expected %s, got %s", attempt, expect, d)
+		}
+	}
+
+	if d := (RetryPolicy{}).delay(3); d != 0 {
+		t.Errorf("expected no delay for the zero policy, got %s", d)
+	}
+	uncapped := RetryPolicy{BaseDelay: time.Second}
+	if d := uncapped.delay(100); d <= 0 {
+		t.Errorf("expected the uncapped delay not to overflow, got %s", d)
+	}
+
+	r.Jitter = true
+	for i := 0; i < 100; i++ {
+		if d := r.delay(3); d < 0 || d > 40*time.Millisecond {
+			t.Fatalf("expected a jittered delay within [0, 40ms], got %s", d)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newTestProducer(t)
+
+	if err := p.Put(ctx, "apple", 10); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := p.Set(ctx, "apple", 4); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 4 {
+		t.Fatalf("expected 4, got %d", q)
+	}
+	if err := p.Set(ctx, "pear", 7); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if q := quantity(t, p, "pear"); q != 7 {
+		t.Fatalf("expected 7, got %d", q)
+	}
+}
+
+func TestAdjustBelowZeroDeletes(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newTestProducer(t)
+
+	if err := p.Put(ctx, "apple", 3); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := p.Adjust(ctx, "apple", 2); err != nil {
+		t.Fatalf("adjusting up: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 5 {
+		t.Fatalf("expected 5, got %d", q)
+	}
+
+	// Unlike takes, adjustments aren't checked
+	if err := p.Adjust(ctx, "apple", -8); err != nil {
+		t.Fatalf("adjusting below zero: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 0 {
+		t.Fatalf("expected 0, got %d", q)
+	}
+	err := p.db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		ok, err := tx.Has("apple")
+		if err == nil && ok {
+			t.Errorf("expected the object to be deleted")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObjectValidator(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newTestProducer(t)
+
+	errLowercase := errors.New("object names must be uppercase")
+	p.SetObjectValidator(func(object string) error {
+		if object != strings.ToUpper(object) {
+			return errLowercase
+		}
+		return nil
+	})
+	if err := p.Put(ctx, "widget", 1); !errors.Is(err, errLowercase) {
+		t.Fatalf("expected the validator error, got %v", err)
+	}
+	err := p.BulkPut(ctx, map[string]int64{"WIDGET": 1, "gadget": 1})
+	if !errors.Is(err, errLowercase) {
+		t.Fatalf("expected the validator error, got %v", err)
+	}
+	if err := p.Put(ctx, "WIDGET", 1); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if q := quantity(t, p, "WIDGET"); q != 1 {
+		t.Fatalf("expected 1, got %d", q)
+	}
+
+	p.SetObjectValidator(nil)
+	if err := p.Put(ctx, "widget", 1); err != nil {
+		t.Fatalf("put after removing the validator: %v", err)
+	}
+}
+
+func TestIdempotencyKeyAppliedOnce(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newTestProducer(t)
+
+	// Retrying an append appends the same event twice
+	for i := 0; i < 2; i++ {
+		if err := p.Put(ctx, "apple", 3, WithIdempotencyKey("k1")); err != nil {
+			t.Fatalf("put %d: %v", i, err)
+		}
+	}
+	if q := quantity(t, p, "apple"); q != 3 {
+		t.Fatalf("expected 3, got %d", q)
+	}
+	if err := p.Put(ctx, "apple", 3, WithIdempotencyKey("k2")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if q := quantity(t, p, "apple"); q != 6 {
+		t.Fatalf("expected 6, got %d", q)
+	}
+}
+
+func TestRunErrorHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, c := newTestProducer(t)
+
+	// Applying fails once armed, after the initial synchronization of Run
+	var armed atomic.Bool
+	errApply := errors.New("apply failed")
+	failing := func(tx *database.Tx, e client.Event) error {
+		if armed.Load() {
+			return errApply
+		}
+		return nil
+	}
+	errs := make(chan error, 64)
+	r := NewProducer(
+		p.db, c, p.log,
+		WithApplyHook(failing),
+		WithErrorHandler(func(err error) { errs <- err }),
+	)
+	s, err := r.Observe(ctx, "apple")
+	if err != nil {
+		t.Fatalf("observing: %v", err)
+	}
+	defer s.Close()
+	runErr := make(chan error, 1)
+	go func() { runErr <- r.Run(ctx) }()
+
+	// Keep appending until Run synchronizes
+	putUntil := func(received func() bool) {
+		t.Helper()
+		timeout := time.After(time.Second)
+		for !received() {
+			if err := p.Put(ctx, "apple", 1); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			select {
+			case err := <-runErr:
+				t.Fatalf("Run returned early: %v", err)
+			case <-timeout:
+				t.Fatalf("timed out")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	putUntil(func() bool {
+		select {
+		case <-s.C:
+			return true
+		default:
+			return false
+		}
+	})
+	armed.Store(true)
+	putUntil(func() bool {
+		select {
+		case err = <-errs:
+			return true
+		default:
+			return false
+		}
+	})
+	if !errors.Is(err, errApply) {
+		t.Fatalf("expected the apply error, got %v", err)
+	}
+
+	// Errors handled by the error handler don't stop Run
+	select {
+	case err := <-runErr:
+		t.Fatalf("Run returned after a handled error: %v", err)
+	default:
+	}
+	cancel()
+	if err := <-runErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
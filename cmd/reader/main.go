@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/romshark/eventlog-example/cli"
+	"github.com/romshark/eventlog-example/database"
+)
+
+func main() {
+	var fDBDir string
+	var fEnableDBLog bool
+	var fLogFormat string
+	flag.StringVar(
+		&fDBDir, "db-dir", "", "database directory",
+	)
+	flag.BoolVar(
+		&fEnableDBLog, "db-log", false, "enable database debug logging",
+	)
+	flag.StringVar(
+		&fLogFormat, "log-format", "text", "log format (text or json)",
+	)
+	flag.Parse()
+
+	l, err := cli.NewLogger(os.Stdout, fLogFormat, slog.LevelDebug)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	lApp := l.With(slog.String("component", "app"))
+	lDB := l.With(slog.String("component", "db"))
+	if !fEnableDBLog {
+		lDB = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	db, err := database.NewReadOnlyDB(fDBDir, lDB)
+	if err != nil {
+		lApp.Error("opening database", slog.Any("error", err))
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if err := db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		v, err := tx.GetProjectionVersion()
+		if err != nil {
+			return fmt.Errorf("reading projection version: %w", err)
+		}
+		if v == "" {
+			lApp.Info("projection version: log empty")
+		} else {
+			lApp.Info("projection version", slog.String("version", v))
+		}
+		return tx.ScanObjects(func(object string, num int64) error {
+			fmt.Printf(" %s: %d\n", object, num)
+			return nil
+		})
+	}); err != nil {
+		lApp.Error("reading database", slog.Any("error", err))
+		os.Exit(1)
+	}
+}
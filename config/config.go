@@ -0,0 +1,184 @@
+// Package config loads the configuration of the services from YAML files
+// and environment variables.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config mirrors the command line flags of the producer and the consumer.
+// The yaml tag of each field is the name of the flag it corresponds to.
+// Nil fields are unset, which allows setting zero values explicitly,
+// for example gc-interval: 0 to disable garbage collection.
+type Config struct {
+	LogAddr             *string   `yaml:"log-addr"`
+	DBDir               *string   `yaml:"db-dir"`
+	EnableDBLog         *bool     `yaml:"db-log"`
+	DBStrict            *bool     `yaml:"db-strict"`
+	GCInterval          *Duration `yaml:"gc-interval"`
+	WarmUp              *bool     `yaml:"warmup-on-start"`
+	PollInterval        *Duration `yaml:"poll-interval"`
+	SyncTimeout         *Duration `yaml:"sync-timeout"`
+	RejectUnknownEvents *bool     `yaml:"reject-unknown-events"`
+	CatchUpBatchSize    *int      `yaml:"catchup-batch-size"`
+	PageSize            *int      `yaml:"page-size"`
+	HistoryFile         *string   `yaml:"history-file"`
+	Script              *string   `yaml:"script"`
+	LogFormat           *string   `yaml:"log-format"`
+	MetricsAddr         *string   `yaml:"metrics-addr"`
+	ShutdownTimeout     *Duration `yaml:"shutdown-timeout"`
+	CLITimeout          *Duration `yaml:"cli-timeout"`
+}
+
+// Duration is a time.Duration decoded from YAML using time.ParseDuration
+// like flags, which accepts "0" without a unit.
+type Duration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	var s string
+	if err := n.Decode(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// String returns the duration formatted by time.Duration.String.
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// EnvPrefix prefixes the environment variables read by FromEnv.
+const EnvPrefix = "EVENTLOG_"
+
+// LoadFile reads the YAML configuration file at path.
+// Unknown keys are rejected to catch typos.
+func LoadFile(path string) (c Config, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+	d := yaml.NewDecoder(f)
+	d.KnownFields(true)
+	if err := d.Decode(&c); err != nil {
+		return Config{}, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// FromEnv reads the configuration from environment variables named after
+// the flags, for example EVENTLOG_LOG_ADDR for -log-addr. Variables set
+// to an empty string set string fields to "" and are invalid otherwise.
+func FromEnv() (c Config, err error) {
+	v := reflect.ValueOf(&c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("yaml")
+		env := EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		s, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), s); err != nil {
+			return Config{}, fmt.Errorf("parsing %s: %w", env, err)
+		}
+	}
+	return c, nil
+}
+
+// setField sets the pointer field f to a new value parsed from s.
+func setField(f reflect.Value, s string) error {
+	p := reflect.New(f.Type().Elem())
+	f.Set(p)
+	f = p.Elem()
+	switch f.Interface().(type) {
+	case string:
+		f.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// Load returns the configuration read from the file at path overridden
+// by the environment (see FromEnv). path == "" skips reading a file.
+func Load(path string) (Config, error) {
+	var file Config
+	if path != "" {
+		var err error
+		if file, err = LoadFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+	env, err := FromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	return Merge(file, env), nil
+}
+
+// Merge returns base with all fields set in override overwriting
+// the fields of base.
+func Merge(base, override Config) Config {
+	b := reflect.ValueOf(&base).Elem()
+	o := reflect.ValueOf(override)
+	for i := 0; i < o.NumField(); i++ {
+		if !o.Field(i).IsNil() {
+			b.Field(i).Set(o.Field(i))
+		}
+	}
+	return base
+}
+
+// Apply sets the flags of fs to the fields set in c unless they were
+// set on the command line, so that flags take precedence over c.
+// Fields without a corresponding flag in fs are ignored.
+// Must be called after fs is parsed.
+func (c Config) Apply(fs *flag.FlagSet) error {
+	setOnCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { setOnCommandLine[f.Name] = true })
+
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("yaml")
+		if v.Field(i).IsNil() ||
+			setOnCommandLine[name] ||
+			fs.Lookup(name) == nil {
+			continue
+		}
+		value := fmt.Sprint(v.Field(i).Elem().Interface())
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("setting flag %s: %w", name, err)
+		}
+	}
+	return nil
+}
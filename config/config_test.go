@@ -0,0 +1,50 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExplicitZeroValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(
+		"gc-interval: 0\nmetrics-addr: \"\"\ndb-dir: ./db\n",
+	), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvPrefix+"DB_DIR", "")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	gcInterval := fs.Duration("gc-interval", 5*time.Minute, "")
+	metricsAddr := fs.String("metrics-addr", ":9090", "")
+	dbDir := fs.String("db-dir", "./default", "")
+	pageSize := fs.Int("page-size", 20, "")
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Apply(fs); err != nil {
+		t.Fatalf("applying: %v", err)
+	}
+
+	if *gcInterval != 0 {
+		t.Errorf("expected gc-interval 0, got %s", *gcInterval)
+	}
+	if *metricsAddr != "" {
+		t.Errorf("expected empty metrics-addr, got %q", *metricsAddr)
+	}
+	if *dbDir != "" {
+		t.Errorf("expected db-dir overridden by the environment, got %q",
+			*dbDir)
+	}
+	if *pageSize != 20 {
+		t.Errorf("expected unset page-size to remain 20, got %d", *pageSize)
+	}
+}
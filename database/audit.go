@@ -0,0 +1,94 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/romshark/eventlog/client"
+)
+
+// AuditEntry is a record of an operation applied to the projection.
+// Object is empty for operations affecting multiple objects.
+type AuditEntry struct {
+	Version   client.Version `json:"version"`
+	Operation string         `json:"operation"`
+	Object    string         `json:"object,omitempty"`
+	Quantity  int64          `json:"quantity"`
+	AppliedAt time.Time      `json:"applied_at"`
+}
+
+// AuditCapacity is the maximum number of audit entries retained,
+// older entries are overwritten.
+const AuditCapacity = 1000
+
+// auditHeadKey is the key of the sequence number of the next audit entry.
+const auditHeadKey = "audit_head"
+
+func auditKey(seq int64) string {
+	return fmt.Sprintf("audit_%04d", seq%AuditCapacity)
+}
+
+func (t *Tx) auditHead() (int64, error) {
+	v, err := t.get(auditHeadKey)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing audit head: %w", err)
+	}
+	return n, nil
+}
+
+// SetAuditEntry records e overwriting the oldest entry
+// once AuditCapacity entries are recorded.
+func (t *Tx) SetAuditEntry(e AuditEntry) error {
+	head, err := t.auditHead()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding audit entry: %w", err)
+	}
+	if err := t.set(auditKey(head), string(b)); err != nil {
+		return err
+	}
+	return t.set(auditHeadKey, strconv.FormatInt(head+1, 10))
+}
+
+// ScanAudit calls fn for each recorded audit entry starting with
+// the most recent one. Return ErrAbortScan from fn to stop scanning.
+func (t *Tx) ScanAudit(fn func(AuditEntry) error) error {
+	head, err := t.auditHead()
+	if err != nil {
+		return err
+	}
+	for seq := head - 1; seq >= 0 && seq >= head-AuditCapacity; seq-- {
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+		v, err := t.get(auditKey(seq))
+		if err != nil {
+			return err
+		}
+		var e AuditEntry
+		if err := json.Unmarshal([]byte(v), &e); err != nil {
+			return fmt.Errorf("decoding audit entry %d: %w", seq, err)
+		}
+		if err := fn(e); err != nil {
+			if err == ErrAbortScan {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package database
+
+import "io"
+
+// Backup writes a full backup of the database to w using badger's
+// streaming backup format. It's safe to call while the database is
+// in use, the backup reflects a consistent snapshot.
+func (d *DB) Backup(w io.Writer) error {
+	_, err := d.db.Backup(w, 0)
+	return err
+}
+
+// Restore loads a backup written by Backup from r. Restored keys overwrite
+// existing ones but keys missing in the backup are kept, so backups should
+// be restored into an empty database.
+func (d *DB) Restore(r io.Reader) error {
+	if d.readOnly {
+		return ErrReadOnlyDatabase
+	}
+	sealed, err := d.IsSealed()
+	if err != nil {
+		return err
+	}
+	if sealed {
+		return ErrDatabaseSealed
+	}
+	d.log.Info("restoring backup")
+	return d.db.Load(r, 16)
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	src := newTestDB(t)
+	want := map[string]int64{"apple": 3, "pear": 1, "kiwi": 42}
+	if err := src.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.SetProjectionVersionBatch("0c", want)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Backup(&buf); err != nil {
+		t.Fatalf("backing up: %v", err)
+	}
+	dst := newTestDB(t)
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("restoring: %v", err)
+	}
+
+	scan := func(db *DB) (objects map[string]int64, v string) {
+		t.Helper()
+		objects = map[string]int64{}
+		err := db.WithinTx(ReadOnly, func(tx *Tx) (err error) {
+			if err := tx.ScanObjects(func(object string, q int64) error {
+				objects[object] = q
+				return nil
+			}); err != nil {
+				return err
+			}
+			v, err = tx.GetProjectionVersion()
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return objects, v
+	}
+	srcObjects, srcVersion := scan(src)
+	dstObjects, dstVersion := scan(dst)
+	if !reflect.DeepEqual(srcObjects, dstObjects) {
+		t.Errorf("expected %v, got %v", srcObjects, dstObjects)
+	}
+	if srcVersion != dstVersion {
+		t.Errorf("expected version %q, got %q", srcVersion, dstVersion)
+	}
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// WriteBatch batches writes for bulk loading, which is much faster than
+// writing within transactions since no conflicts are tracked.
+//
+// WARNING: batch writes are not transactional and can't be rolled back!
+// Writes may already be persisted before Flush is called and a failing
+// Flush can leave the database partially written.
+type WriteBatch struct {
+	d      *DB
+	wb     *badger.WriteBatch
+	strict bool
+}
+
+// NewBatch creates a new write batch.
+// The object counter isn't maintained by the batch itself and is instead
+// recalculated by WriteBatch.Flush.
+func (d *DB) NewBatch() *WriteBatch {
+	return &WriteBatch{
+		d:      d,
+		wb:     d.db.NewWriteBatch(),
+		strict: d.strict,
+	}
+}
+
+// Set writes an object entry.
+func (b *WriteBatch) Set(object string, quantity int64) error {
+	if err := b.wb.Set(
+		[]byte("o_"+object), []byte(fmt.Sprintf("%d", quantity)),
+	); err != nil {
+		return err
+	}
+	if b.strict {
+		return b.wb.Set(
+			[]byte("t_"+object),
+			[]byte(time.Now().UTC().Format(time.RFC3339Nano)),
+		)
+	}
+	return nil
+}
+
+// Delete deletes an object entry.
+func (b *WriteBatch) Delete(object string) error {
+	if err := b.wb.Delete([]byte("v_" + object)); err != nil {
+		return err
+	}
+	if b.strict {
+		if err := b.wb.Delete([]byte("t_" + object)); err != nil {
+			return err
+		}
+	}
+	return b.wb.Delete([]byte("o_" + object))
+}
+
+// Flush writes all pending writes and recalculates the object counter.
+// ErrDatabaseSealed is returned and all pending writes are canceled
+// if the database is sealed.
+func (b *WriteBatch) Flush() error {
+	sealed, err := b.d.IsSealed()
+	if err != nil {
+		b.wb.Cancel()
+		return err
+	}
+	if sealed {
+		b.wb.Cancel()
+		return ErrDatabaseSealed
+	}
+	if err := b.wb.Flush(); err != nil {
+		return err
+	}
+	b.d.log.Info("flushed write batch")
+	_, err = b.d.RecalculateObjectCount(context.Background())
+	return err
+}
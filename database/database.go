@@ -1,10 +1,20 @@
 package database
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/romshark/eventlog/client"
@@ -12,125 +22,1827 @@ import (
 
 // DB is an ACID database based on the dgraph-io/badger key-value store.
 type DB struct {
-	db  *badger.DB
-	log *log.Logger
+	db       *badger.DB
+	log      *slog.Logger
+	strict   bool
+	readOnly bool
+
+	historyLimit     int
+	lockTimeout      time.Duration
+	txStats          bool
+	idemKeyRetention time.Duration
+
+	warmUpProgress func(keysRead int64)
+
+	// gcInterval is set by WithGCInterval and stopGC stops
+	// the background garbage collection it enables.
+	gcInterval time.Duration
+	stopGC     func()
+
+	gcStatsLock sync.Mutex
+	gcStats     GCStats
+
+	// objectDeltaSeq makes the keys of object count deltas
+	// written within the same nanosecond unique.
+	objectDeltaSeq atomic.Uint64
+}
+
+// Option configures a DB.
+type Option func(*DB)
+
+// WithStrictConsistencyChecks enables writing a "t_" timestamp key
+// alongside every object entry and makes Tx.Exists verify it.
+func WithStrictConsistencyChecks(enabled bool) Option {
+	return func(d *DB) { d.strict = enabled }
+}
+
+// WithVersionHistoryLimit limits the number of projection version
+// transitions recorded in the version history to n, deleting the oldest
+// records once the limit is exceeded. The default limit is 1000 records.
+// A limit of 0 disables the version history.
+// Only the final projection version of each committed transaction
+// is recorded.
+func WithVersionHistoryLimit(n int) Option {
+	return func(d *DB) { d.historyLimit = n }
+}
+
+// WithIdempotencyKeyRetention sets for how long after an event was recorded
+// Tx.RecordIdempotencyKey treats later events carrying the same key
+// as duplicates. The default retention is 24 hours.
+// A retention of 0 retains keys forever.
+func WithIdempotencyKeyRetention(d time.Duration) Option {
+	return func(db *DB) { db.idemKeyRetention = d }
+}
+
+// WithGCInterval makes the database run value log garbage collection
+// in the background every interval until it's closed
+// (see RunPeriodicGC). It's disabled by default.
+func WithGCInterval(interval time.Duration) Option {
+	return func(d *DB) { d.gcInterval = interval }
+}
+
+// WithTxStats enables logging the statistics of each transaction
+// at debug level after it's committed.
+func WithTxStats(enabled bool) Option {
+	return func(d *DB) { d.txStats = enabled }
+}
+
+// Open opens a badger database.
+// If dir == "" then an in-memory database is created.
+func Open(dir string, l *slog.Logger, opts ...Option) (*DB, error) {
+	db, err := badger.Open(
+		badger.DefaultOptions(dir).
+			WithInMemory(dir == "").
+			WithLoggingLevel(badger.WARNING),
+	)
+	if err != nil {
+		return nil, err
+	}
+	d := &DB{
+		db:           db,
+		log:          l,
+		historyLimit: 1000,
+		lockTimeout:  30 * time.Second,
+
+		idemKeyRetention: 24 * time.Hour,
+	}
+	for _, o := range opts {
+		o(d)
+	}
+	if err := d.clearStaleLocks(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("clearing stale locks: %w", err)
+	}
+	if d.gcInterval > 0 {
+		d.stopGC = d.RunPeriodicGC(context.Background(), d.gcInterval)
+	}
+	return d, nil
+}
+
+// NewReadOnlyDB opens the badger database in dir in read-only mode.
+// Badger allows multiple processes to open the same directory in read-only
+// mode but not while another process holds it open for writing.
+// ReadWrite transactions on a read-only database fail with
+// ErrReadOnlyDatabase.
+func NewReadOnlyDB(dir string, l *slog.Logger) (*DB, error) {
+	if dir == "" {
+		return nil, errors.New("read-only mode requires a database directory")
+	}
+	db, err := badger.Open(
+		badger.DefaultOptions(dir).
+			WithReadOnly(true).
+			WithLoggingLevel(badger.WARNING),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{
+		db:       db,
+		log:      l,
+		readOnly: true,
+	}, nil
+}
+
+func (d *DB) Close() error {
+	if d.stopGC != nil {
+		d.stopGC()
+	}
+	d.log.Info("closing")
+	return d.db.Close()
+}
+
+// Reset deletes all data stored in the database.
+func (d *DB) Reset() error {
+	if d.readOnly {
+		return ErrReadOnlyDatabase
+	}
+	sealed, err := d.IsSealed()
+	if err != nil {
+		return err
+	}
+	if sealed {
+		return ErrDatabaseSealed
+	}
+	d.log.Info("resetting")
+	return d.db.DropAll()
+}
+
+// Seal freezes the database recording the time and projection version
+// it was sealed at. A sealed database remains readable but rejects all
+// ReadWrite transactions with ErrDatabaseSealed until unsealed.
+func (d *DB) Seal(ctx context.Context) error {
+	return d.WithinTxContext(ctx, ReadWrite, func(tx *Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		v, err := tx.GetProjectionVersion()
+		if err != nil {
+			return err
+		}
+		return tx.set(
+			"sealed_at",
+			time.Now().UTC().Format(time.RFC3339Nano)+" "+v,
+		)
+	})
+}
+
+// IsSealed returns true if the database is sealed.
+func (d *DB) IsSealed() (sealed bool, err error) {
+	err = d.WithinTx(ReadOnly, func(tx *Tx) error {
+		sealed, err = tx.has("sealed_at")
+		return err
+	})
+	return
+}
+
+// Unseal unseals a sealed database logging the reason.
+func (d *DB) Unseal(reason string) error {
+	return d.withinTx(context.Background(), ReadWrite, false, func(
+		tx *Tx,
+	) error {
+		v, err := tx.get("sealed_at")
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return ErrNotSealed
+			}
+			return err
+		}
+		d.log.Info(
+			"unsealing",
+			slog.String("sealed_at", v), slog.String("reason", reason),
+		)
+		return tx.delete("sealed_at")
+	})
+}
+
+// EstimateCount returns an approximate number of keys starting with prefix
+// based on the key counts of the on-disk tables overlapping prefix,
+// which is much cheaper than scanning the keys. The estimate includes
+// stale versions and deletions and over-counts tables only partially
+// overlapping prefix. If no table overlaps prefix, for example when all
+// keys are still held in memory, the keys are counted exactly instead.
+func (d *DB) EstimateCount(prefix string) (int64, error) {
+	p := []byte(prefix)
+	var count int64
+	var overlapping bool
+	for _, t := range d.db.Tables() {
+		left, right := parseTableKey(t.Left), parseTableKey(t.Right)
+		if bytes.Compare(right, p) < 0 ||
+			(bytes.Compare(left, p) > 0 && !bytes.HasPrefix(left, p)) {
+			continue
+		}
+		overlapping = true
+		count += int64(t.KeyCount)
+	}
+	if overlapping {
+		return count, nil
+	}
+
+	err := d.WithinTx(ReadOnly, func(tx *Tx) error {
+		return tx.scanPrefix(prefix, func(key, value string) error {
+			count++
+			return nil
+		})
+	})
+	return count, err
+}
+
+// parseTableKey strips the 8 byte timestamp suffix off a badger table key.
+func parseTableKey(k []byte) []byte {
+	if len(k) < 8 {
+		return k
+	}
+	return k[:len(k)-8]
+}
+
+// MergeStrategy resolves a conflict of key between our value
+// and their value returning the value to keep.
+type MergeStrategy func(key, ours, theirs string) string
+
+// MergeOurs is a MergeStrategy keeping our value.
+func MergeOurs(key, ours, theirs string) string { return ours }
+
+// MergeTheirs is a MergeStrategy keeping their value.
+func MergeTheirs(key, ours, theirs string) string { return theirs }
+
+// Merge copies all keys from other into the database resolving conflicts
+// using strategy. If strategy is nil then conflicting objects are resolved
+// by last-write-wins based on their "t_" timestamps if both are available
+// and are otherwise overwritten by other.
+// The resulting projection version is the greater of both versions.
+func (d *DB) Merge(
+	ctx context.Context,
+	other *DB,
+	strategy MergeStrategy,
+) error {
+	theirs := map[string]string{}
+	if err := other.WithinTxContext(ctx, ReadOnly, func(tx *Tx) error {
+		return tx.scanPrefix("", func(key, value string) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			theirs[key] = value
+			return nil
+		})
+	}); err != nil {
+		return fmt.Errorf("reading other database: %w", err)
+	}
+
+	return d.WithinTxContext(ctx, ReadWrite, func(tx *Tx) error {
+		for key, their := range theirs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if key == "sealed_at" || strings.HasPrefix(key, objectCountKey) ||
+				key == schemaVersionKey || key == historyLenKey ||
+				strings.HasPrefix(key, "t_") ||
+				strings.HasPrefix(key, "vh_") ||
+				strings.HasPrefix(key, "audit_") ||
+				strings.HasPrefix(key, "idem_") ||
+				strings.HasPrefix(key, idemKeyPrefix) ||
+				strings.HasPrefix(key, "lock_") {
+				// Timestamps are merged alongside their objects,
+				// the object count is adjusted for new objects
+				// and neither the version history, audit entries,
+				// idempotency tokens nor locks are merged
+				continue
+			}
+			our, err := tx.get(key)
+			if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+			found := err == nil
+			if found && our == their {
+				continue
+			}
+
+			keep := their
+			switch {
+			case key == "version":
+				if CompareVersions(our, their) > 0 {
+					keep = our
+				}
+			case !found:
+			case strategy != nil:
+				keep = strategy(key, our, their)
+			case strings.HasPrefix(key, "o_"):
+				tsKey := "t_" + key[len("o_"):]
+				ourTS, errOurs := tx.get(tsKey)
+				if errOurs != nil &&
+					!errors.Is(errOurs, badger.ErrKeyNotFound) {
+					return errOurs
+				}
+				if theirTS, ok := theirs[tsKey]; ok && errOurs == nil &&
+					!isNewer(theirTS, ourTS) {
+					keep = our
+				}
+			}
+			if found && keep == our {
+				continue
+			}
+
+			d.log.Info(
+				"merging",
+				slog.String("key", key),
+				slog.String("ours", our), slog.String("kept", keep),
+			)
+			if err := tx.set(key, keep); err != nil {
+				return err
+			}
+			if strings.HasPrefix(key, "o_") {
+				if !found {
+					tx.objectDelta++
+				}
+				ts, ok := theirs["t_"+key[len("o_"):]]
+				if ok && keep == their {
+					if err := tx.set("t_"+key[len("o_"):], ts); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// isNewer returns true if timestamp a is newer than timestamp b.
+func isNewer(a, b string) bool {
+	ta, errA := time.Parse(time.RFC3339Nano, a)
+	tb, errB := time.Parse(time.RFC3339Nano, b)
+	if errA != nil || errB != nil {
+		return errB != nil
+	}
+	return ta.After(tb)
+}
+
+// IntegrityError describes an integrity issue of a stored key.
+type IntegrityError struct {
+	Key   string
+	Issue string
+}
+
+func (e IntegrityError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Issue)
+}
+
+// CheckIntegrity scans all keys of the database
+// and returns all integrity issues found.
+func (d *DB) CheckIntegrity(ctx context.Context) (
+	issues []IntegrityError,
+	err error,
+) {
+	err = d.WithinTxContext(ctx, ReadOnly, func(tx *Tx) error {
+		issues, err = tx.checkIntegrity(ctx, false)
+		return err
+	})
+	return
+}
+
+// FixIntegrity is similar to CheckIntegrity but also deletes orphaned
+// "t_" and "v_" keys, corrects the object count and deletes
+// the projection version if no objects are stored.
+func (d *DB) FixIntegrity(ctx context.Context) (
+	issues []IntegrityError,
+	err error,
+) {
+	err = d.WithinTxContext(ctx, ReadWrite, func(tx *Tx) error {
+		issues, err = tx.checkIntegrity(ctx, true)
+		return err
+	})
+	return
+}
+
+// GetAllVersions returns the versions at which each object stored
+// with a version was last modified.
+func (d *DB) GetAllVersions(
+	ctx context.Context,
+) (versions map[string]client.Version, err error) {
+	versions = map[string]client.Version{}
+	err = d.WithinTxContext(ctx, ReadOnly, func(tx *Tx) error {
+		return tx.scanPrefix("v_", func(key, value string) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			versions[key[len("v_"):]] = value
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Rollback resets the projection to its state at toVersion.
+// Since previous states of objects aren't stored the projection, including
+// reservations and scheduled expiries, is cleared and replay is called
+// within the same transaction to re-apply all events up to and including
+// toVersion (see Consumer.Rollback).
+// ErrRollbackVersionNotReached is returned and the projection is left
+// untouched if the projection version differs from toVersion after replay.
+func (d *DB) Rollback(
+	ctx context.Context,
+	toVersion client.Version,
+	replay func(tx *Tx) error,
+) error {
+	return d.WithinTxContext(ctx, ReadWrite, func(tx *Tx) error {
+		var expiries []string
+		if err := tx.scanPrefix("x_", func(key, _ string) error {
+			expiries = append(expiries, key)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expiries {
+			if err := tx.delete(k); err != nil {
+				return err
+			}
+		}
+		if err := tx.SetProjectionVersionBatch("", nil); err != nil {
+			return fmt.Errorf("clearing projection: %w", err)
+		}
+		if err := replay(tx); err != nil {
+			return err
+		}
+		v, err := tx.GetProjectionVersion()
+		if err != nil {
+			return err
+		}
+		if v != toVersion {
+			return ErrRollbackVersionNotReached
+		}
+		d.log.Info("rolled back", slog.String("version", toVersion))
+		return nil
+	})
+}
+
+var ErrRollbackVersionNotReached = errors.New(
+	"rollback version not reached",
+)
+
+// ObjectCount returns the number of stored objects read from the object
+// counter maintained by Tx.Set and Tx.Delete, which is much cheaper than
+// counting the objects. The counter is initialized by a full scan
+// if it's missing, for example in databases written before it was
+// introduced. Since every transaction changing the number of objects
+// records its own delta to avoid conflicts between them, ObjectCount
+// folds the deltas into the counter once enough of them accumulated.
+func (d *DB) ObjectCount() (count int64, err error) {
+	var c objectCounter
+	if err := d.WithinTx(ReadOnly, func(tx *Tx) (err error) {
+		c, err = tx.readObjectCounter()
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	switch {
+	case !c.initialized && d.readOnly:
+		err = d.WithinTx(ReadOnly, func(tx *Tx) error {
+			count, err = tx.countObjects(context.Background())
+			return err
+		})
+		return count, err
+	case !c.initialized:
+		return d.RecalculateObjectCount(context.Background())
+	case len(c.deltaKeys) >= objectCountFoldLimit && !d.readOnly:
+		if err := d.WithinTx(ReadWrite, func(tx *Tx) error {
+			return tx.foldObjectCount()
+		}); err != nil {
+			// Folding is retried by the next call
+			d.log.Debug("folding object count", slog.Any("error", err))
+		}
+	}
+	return c.count(), nil
+}
+
+// RecalculateObjectCount counts all stored objects
+// and overwrites the object counter with the result.
+func (d *DB) RecalculateObjectCount(ctx context.Context) (
+	count int64,
+	err error,
+) {
+	err = d.WithinTxContext(ctx, ReadWrite, func(tx *Tx) error {
+		if count, err = tx.countObjects(ctx); err != nil {
+			return err
+		}
+		return tx.resetObjectCount(count)
+	})
+	return
+}
+
+// TxType defines a transaction type
+type TxType bool
+
+const (
+	ReadOnly  TxType = false
+	ReadWrite TxType = true
+)
+
+// WithinTx creates a new database transaction and executes fn within it.
+// The transaction is automatically commited if fn returns nil.
+// ErrDatabaseSealed is returned for ReadWrite transactions
+// if the database is sealed.
+func (d *DB) WithinTx(
+	tt TxType,
+	fn func(*Tx) error,
+) (err error) {
+	return d.withinTx(context.Background(), tt, true, fn)
+}
+
+// WithinTxContext is similar to WithinTx but all scans performed within
+// the transaction stop with ctx.Err() once ctx is canceled,
+// in which case the transaction is discarded unless fn ignores the error.
+func (d *DB) WithinTxContext(
+	ctx context.Context,
+	tt TxType,
+	fn func(*Tx) error,
+) (err error) {
+	return d.withinTx(ctx, tt, true, fn)
+}
+
+func (d *DB) withinTx(
+	ctx context.Context,
+	tt TxType,
+	checkSeal bool,
+	fn func(*Tx) error,
+) (err error) {
+	if tt == ReadWrite && d.readOnly {
+		return ErrReadOnlyDatabase
+	}
+	t := &Tx{
+		ctx:    ctx,
+		tx:     d.db.NewTransaction(bool(tt)),
+		strict: d.strict,
+
+		historyLimit:     d.historyLimit,
+		idemKeyRetention: d.idemKeyRetention,
+	}
+	t.log = d.log.With(slog.String("tx", fmt.Sprintf("%p", t)))
+	defer func() {
+		if err == nil {
+			err = t.recordVersionHistory()
+		}
+		if err == nil && t.objectDelta != 0 {
+			err = t.set(d.objectDeltaKey(), strconv.FormatInt(
+				t.objectDelta, 10,
+			))
+		}
+		if err != nil {
+			t.tx.Discard()
+			t.log.Debug("discarded")
+			return
+		}
+		if err = t.tx.Commit(); err != nil {
+			return
+		}
+		t.log.Debug("committed")
+		if d.txStats {
+			t.log.Debug(
+				"tx stats",
+				slog.Int64("keys_read", t.stats.KeysRead),
+				slog.Int64("keys_written", t.stats.KeysWritten),
+				slog.Int64("bytes_read", t.stats.BytesRead),
+				slog.Int64("bytes_written", t.stats.BytesWritten),
+			)
+		}
+		for _, fn := range t.onCommit {
+			fn()
+		}
+	}()
+	t.log.Debug("created")
+	if tt == ReadWrite && checkSeal {
+		sealed, err := t.has("sealed_at")
+		if err != nil {
+			return err
+		}
+		if sealed {
+			return ErrDatabaseSealed
+		}
+	}
+	return fn(t)
+}
+
+// Tx is a database transaction.
+type Tx struct {
+	ctx      context.Context
+	tx       *badger.Txn
+	log      *slog.Logger
+	strict   bool
+	onCommit []func()
+	stats    TxStats
+
+	// pending records all writes if debug mode is enabled
+	pending map[string]pendingWrite
+
+	historyLimit     int
+	idemKeyRetention time.Duration
+
+	// versionSet is the last projection version transition,
+	// which is recorded in the version history on commit
+	versionSet *VersionRecord
+
+	// objectDelta is the change of the number of objects,
+	// which is recorded as an object count delta on commit
+	objectDelta int64
+}
+
+type pendingWrite struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Deleted bool   `json:"deleted"`
+}
+
+// EnableDebugMode makes the transaction record all subsequent writes
+// for FlushToWriter. Not intended for production use.
+func (t *Tx) EnableDebugMode() {
+	if t.pending == nil {
+		t.pending = map[string]pendingWrite{}
+	}
+}
+
+// FlushToWriter writes all writes recorded since debug mode was enabled
+// to w as JSON, one write per line in lexicographical order of the keys.
+// ErrDebugModeDisabled is returned if debug mode isn't enabled.
+func (t *Tx) FlushToWriter(w io.Writer) error {
+	if t.pending == nil {
+		return ErrDebugModeDisabled
+	}
+	keys := make([]string, 0, len(t.pending))
+	for k := range t.pending {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	enc := json.NewEncoder(w)
+	for _, k := range keys {
+		if err := enc.Encode(t.pending[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record records a write if debug mode is enabled.
+func (t *Tx) record(key, value string, deleted bool) {
+	if t.pending != nil {
+		t.pending[key] = pendingWrite{Key: key, Value: value, Deleted: deleted}
+	}
+}
+
+// TxStats are the statistics of a transaction.
+type TxStats struct {
+	KeysRead     int64
+	KeysWritten  int64
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// Add returns the sum of s and other.
+func (s TxStats) Add(other TxStats) TxStats {
+	return TxStats{
+		KeysRead:     s.KeysRead + other.KeysRead,
+		KeysWritten:  s.KeysWritten + other.KeysWritten,
+		BytesRead:    s.BytesRead + other.BytesRead,
+		BytesWritten: s.BytesWritten + other.BytesWritten,
+	}
+}
+
+// GetStats returns the number of keys and bytes read and written
+// by the transaction so far.
+func (t *Tx) GetStats() (TxStats, error) {
+	return t.stats, nil
+}
+
+// OnCommit registers fn to be called after the transaction is committed.
+// fn isn't called if the transaction is discarded.
+func (t *Tx) OnCommit(fn func()) {
+	t.onCommit = append(t.onCommit, fn)
+}
+
+// Delete deletes an object from the database.
+func (t *Tx) Delete(object string) error {
+	ok, err := t.Has(object)
+	if err != nil {
+		return err
+	}
+	if ok {
+		t.objectDelta--
+	}
+	if err := t.delete("v_" + object); err != nil {
+		return err
+	}
+	if t.strict {
+		if err := t.delete("t_" + object); err != nil {
+			return err
+		}
+	}
+	return t.delete("o_" + object)
+}
+
+// DeleteAll deletes all object entries and reservations
+// from the database.
+func (t *Tx) DeleteAll() error {
+	var objects []string
+	if err := t.ScanObjects(func(object string, _ int64) error {
+		objects = append(objects, object)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := t.BatchDelete(objects); err != nil {
+		return err
+	}
+	var reserved []string
+	if err := t.scanPrefix("reserved_", func(key, _ string) error {
+		reserved = append(reserved, key)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := t.scanPrefix("reservation_", func(key, _ string) error {
+		reserved = append(reserved, key)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range reserved {
+		if err := t.delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchDelete deletes the entries of all objects. The error of the first
+// failing deletion is returned, in which case the transaction must be
+// discarded.
+func (t *Tx) BatchDelete(objects []string) error {
+	for _, o := range objects {
+		if err := t.Delete(o); err != nil {
+			return fmt.Errorf("deleting %q: %w", o, err)
+		}
+	}
+	return nil
+}
+
+// BatchSet updates the entries of all objects in items in lexicographical
+// order. The error of the first failing write is returned, in which case
+// the transaction must be discarded.
+func (t *Tx) BatchSet(items map[string]int64) error {
+	objects := make([]string, 0, len(items))
+	for o := range items {
+		objects = append(objects, o)
+	}
+	sort.Strings(objects)
+	for _, o := range objects {
+		if err := t.Set(o, items[o]); err != nil {
+			return fmt.Errorf("setting %q: %w", o, err)
+		}
+	}
+	return nil
+}
+
+// Set updates an object entry in the database.
+func (t *Tx) Set(object string, num int64) error {
+	ok, err := t.Has(object)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		t.objectDelta++
+	}
+	if err := t.set("o_"+object, fmt.Sprintf("%d", num)); err != nil {
+		return err
+	}
+	if t.strict {
+		return t.set("t_"+object, time.Now().UTC().Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// SetWithVersion is similar to Set but also records the version
+// at which the object was last modified.
+func (t *Tx) SetWithVersion(
+	object string,
+	quantity int64,
+	version client.Version,
+) error {
+	if err := t.Set(object, quantity); err != nil {
+		return err
+	}
+	return t.set("v_"+object, version)
+}
+
+// GetQuantityAndVersion reads the stored quantity of a particular object
+// type and the version at which it was last modified. lastVersion is empty
+// if the object isn't stored or was stored without a version.
+func (t *Tx) GetQuantityAndVersion(object string) (
+	quantity int64,
+	lastVersion client.Version,
+	err error,
+) {
+	if quantity, err = t.GetQuantity(object); err != nil {
+		return 0, "", err
+	}
+	if lastVersion, err = t.GetObjectVersion(object); err != nil {
+		return 0, "", err
+	}
+	return quantity, lastVersion, nil
+}
+
+// GetObjectVersion returns the version at which object was last modified.
+// The returned version is empty if the object isn't stored
+// or was stored without a version.
+func (t *Tx) GetObjectVersion(object string) (client.Version, error) {
+	v, err := t.get("v_" + object)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	return v, nil
+}
+
+// Has returns true if an entry for object exists in the database.
+func (t *Tx) Has(object string) (bool, error) {
+	return t.has("o_" + object)
+}
+
+// Exists returns true if an entry for object exists in the database.
+// Unlike Has, if strict consistency checks are enabled Exists also
+// requires the "t_" timestamp key of the object to be present and returns
+// false for partially written entries.
+func (t *Tx) Exists(object string) (bool, error) {
+	ok, err := t.Has(object)
+	if err != nil || !ok || !t.strict {
+		return ok, err
+	}
+	return t.has("t_" + object)
+}
+
+// SetProjectionVersion changes the projection version of the database
+// recording the transition at the current time.
+func (t *Tx) SetProjectionVersion(version client.Version) error {
+	return t.SetProjectionVersionAt(version, time.Now())
+}
+
+// SetProjectionVersionBatch replaces all objects in the database
+// with objects and sets the projection version to version.
+// An empty objects map clears all objects.
+func (t *Tx) SetProjectionVersionBatch(
+	version client.Version,
+	objects map[string]int64,
+) error {
+	if err := t.DeleteAll(); err != nil {
+		return err
+	}
+	if err := t.BatchSet(objects); err != nil {
+		return err
+	}
+	return t.SetProjectionVersion(version)
+}
+
+// SetProjectionVersionAt changes the projection version of the database
+// recording the transition in the version history at the given time
+// once the transaction is committed. Only the last transition
+// of a transaction is recorded.
+func (t *Tx) SetProjectionVersionAt(
+	version client.Version,
+	appliedAt time.Time,
+) error {
+	if err := t.set("version", version); err != nil {
+		return err
+	}
+	if t.historyLimit > 0 {
+		t.versionSet = &VersionRecord{Version: version, AppliedAt: appliedAt}
+	}
+	return nil
+}
+
+// maxHistoryTrim limits the number of version history records deleted
+// by a single transaction, so lowering the limit of a large history
+// trims it over multiple transactions instead of failing with
+// badger.ErrTxnTooBig.
+const maxHistoryTrim = 100
+
+// recordVersionHistory records the last projection version transition
+// of the transaction, if any, and deletes the oldest records exceeding
+// the history limit.
+func (t *Tx) recordVersionHistory() error {
+	r := t.versionSet
+	if r == nil {
+		return nil
+	}
+	t.versionSet = nil
+	if err := t.set(
+		fmt.Sprintf("vh_%020d_%s", r.AppliedAt.UnixNano(), r.Version),
+		r.Version,
+	); err != nil {
+		return err
+	}
+
+	n, err := t.historyLen()
+	if err != nil {
+		return err
+	}
+	n++
+	excess := n - int64(t.historyLimit)
+	if excess > maxHistoryTrim {
+		excess = maxHistoryTrim
+	}
+	if excess > 0 {
+		// Delete the oldest records
+		oldest := make([]string, 0, excess)
+		if err := t.scanPrefix("vh_", func(key, value string) error {
+			oldest = append(oldest, key)
+			if int64(len(oldest)) >= excess {
+				return ErrAbortScan
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range oldest {
+			if err := t.delete(k); err != nil {
+				return err
+			}
+		}
+		n -= int64(len(oldest))
+	}
+	return t.set(historyLenKey, strconv.FormatInt(n, 10))
+}
+
+// VersionRecord is a projection version transition.
+type VersionRecord struct {
+	Version   client.Version
+	AppliedAt time.Time
+}
+
+// GetProjectionVersionHistory returns the recorded projection version
+// transitions in chronological order.
+func (t *Tx) GetProjectionVersionHistory() (
+	records []VersionRecord,
+	err error,
+) {
+	err = t.scanPrefix("vh_", func(key, value string) error {
+		// Key format: vh_<unix nanoseconds>_<version>
+		k := key[len("vh_"):]
+		if len(k) <= timeKeyLen {
+			return fmt.Errorf("malformed version history key: %q", key)
+		}
+		nanos, err := strconv.ParseInt(k[:timeKeyLen], 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing version history time: %w", err)
+		}
+		records = append(records, VersionRecord{
+			Version:   value,
+			AppliedAt: time.Unix(0, nanos),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// historyLenKey is the key of the number of version history records.
+const historyLenKey = "version_history_len"
+
+func (t *Tx) historyLen() (int64, error) {
+	v, err := t.get(historyLenKey)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing version history length: %w", err)
+	}
+	return n, nil
+}
+
+// SetVersionIfNewer changes the projection version of the database
+// only if version is greater than the current projection version
+// (see CompareVersions).
+func (t *Tx) SetVersionIfNewer(
+	version client.Version,
+) (changed bool, err error) {
+	current, err := t.GetProjectionVersion()
+	if err != nil {
+		return false, err
+	}
+	if CompareVersions(version, current) <= 0 {
+		return false, nil
+	}
+	if err := t.SetProjectionVersion(version); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetQuantity reads the stored quantity of a particular object type.
+// Returns 0 if the object isn't stored.
+func (t *Tx) GetQuantity(object string) (num int64, err error) {
+	return t.GetQuantityWithDefault(object, 0)
+}
+
+// GetQuantityWithDefault reads the stored quantity of a particular
+// object type and returns defaultVal if the object isn't stored.
+func (t *Tx) GetQuantityWithDefault(
+	object string,
+	defaultVal int64,
+) (num int64, err error) {
+	v, err := t.get("o_" + object)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return defaultVal, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(string(v), 10, 64)
+}
+
+// GetQuantityPositive reads the stored quantity of a particular object type.
+// exists is false if the object isn't stored or its quantity isn't positive.
+func (t *Tx) GetQuantityPositive(object string) (
+	quantity int64,
+	exists bool,
+	err error,
+) {
+	if quantity, err = t.GetQuantity(object); err != nil {
+		return 0, false, err
+	}
+	return quantity, quantity > 0, nil
+}
+
+// GetReserved reads the reserved quantity of a particular object type.
+// Returns 0 if nothing is reserved.
+func (t *Tx) GetReserved(object string) (int64, error) {
+	v, err := t.get("reserved_" + object)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// SetReserved updates the reserved quantity of an object type.
+func (t *Tx) SetReserved(object string, quantity int64) error {
+	return t.set("reserved_"+object, fmt.Sprintf("%d", quantity))
+}
+
+// DeleteReserved deletes the reserved quantity of an object type.
+func (t *Tx) DeleteReserved(object string) error {
+	return t.delete("reserved_" + object)
+}
+
+// reservationKey returns the key of the reservation with the given ID,
+// whose value is the reserved quantity followed by a space and the object.
+func reservationKey(id string) string { return "reservation_" + id }
+
+// GetReservation reads the object and quantity reserved by
+// the reservation with the given ID. ok is false if no such
+// reservation exists.
+func (t *Tx) GetReservation(id string) (
+	object string,
+	quantity int64,
+	ok bool,
+	err error,
+) {
+	v, err := t.get(reservationKey(id))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return "", 0, false, nil
+		}
+		return "", 0, false, err
+	}
+	q, object, found := strings.Cut(v, " ")
+	if !found {
+		return "", 0, false, fmt.Errorf("malformed reservation: %q", v)
+	}
+	if quantity, err = strconv.ParseInt(q, 10, 64); err != nil {
+		return "", 0, false, fmt.Errorf("parsing reservation: %w", err)
+	}
+	return object, quantity, true, nil
+}
+
+// SetReservation records that the reservation with the given ID reserves
+// quantity objects of the given type. Unlike SetReserved it doesn't affect
+// the reserved quantity of the object.
+func (t *Tx) SetReservation(id, object string, quantity int64) error {
+	return t.set(reservationKey(id), fmt.Sprintf("%d %s", quantity, object))
+}
+
+// DeleteReservation deletes the reservation with the given ID.
+func (t *Tx) DeleteReservation(id string) error {
+	return t.delete(reservationKey(id))
+}
+
+// scanReservations calls fn for each reservation.
+func (t *Tx) scanReservations(
+	fn func(id, object string, quantity int64) error,
+) error {
+	return t.scanPrefix("reservation_", func(key, value string) error {
+		q, object, found := strings.Cut(value, " ")
+		if !found {
+			return fmt.Errorf("malformed reservation: %q", value)
+		}
+		n, err := strconv.ParseInt(q, 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing reservation: %w", err)
+		}
+		return fn(key[len("reservation_"):], object, n)
+	})
+}
+
+// GetMany reads the stored quantities of the given objects.
+// Objects that aren't stored in the database are returned in missing.
+func (t *Tx) GetMany(objects []string) (
+	quantities map[string]int64,
+	missing []string,
+	err error,
+) {
+	quantities = make(map[string]int64, len(objects))
+	for _, o := range objects {
+		v, err := t.get("o_" + o)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				missing = append(missing, o)
+				continue
+			}
+			return nil, nil, err
+		}
+		if quantities[o], err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("parsing quantity of %q: %w", o, err)
+		}
+	}
+	return quantities, missing, nil
+}
+
+// GetProjectionVersion reads the projection version of the database,
+// which is empty if no version is stored (see GetVersionOrZero).
+func (t *Tx) GetProjectionVersion() (client.Version, error) {
+	return t.GetVersionOrZero()
+}
+
+// GetVersionOrZero reads the projection version of the database
+// and returns the zero version "" instead of an error
+// if the database is empty.
+func (t *Tx) GetVersionOrZero() (client.Version, error) {
+	v, err := t.get("version")
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	return v, nil
 }
 
-// Open opens a badger database.
-// If dir == "" then an in-memory database is created.
-func Open(dir string, l *log.Logger) (*DB, error) {
-	db, err := badger.Open(
-		badger.DefaultOptions(dir).
-			WithInMemory(dir == "").
-			WithLoggingLevel(badger.WARNING),
-	)
-	if err != nil {
+// ObjectChange describes the current state of an object
+// and the version at which it was last modified.
+type ObjectChange struct {
+	Object      string
+	Quantity    int64
+	LastVersion client.Version
+}
+
+// GetChangesSince returns all objects last modified at a version greater
+// than sinceVersion. Objects stored without a version and deleted objects
+// aren't included.
+func (t *Tx) GetChangesSince(
+	sinceVersion client.Version,
+) (changes []ObjectChange, err error) {
+	var modified []ObjectChange
+	if err := t.scanPrefix("v_", func(key, value string) error {
+		if CompareVersions(value, sinceVersion) > 0 {
+			modified = append(modified, ObjectChange{
+				Object:      key[len("v_"):],
+				LastVersion: value,
+			})
+		}
+		return nil
+	}); err != nil {
 		return nil, err
 	}
-	return &DB{
-		db:  db,
-		log: l,
-	}, nil
+	for _, c := range modified {
+		if c.Quantity, err = t.GetQuantity(c.Object); err != nil {
+			return nil, fmt.Errorf("reading quantity of %q: %w", c.Object, err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
 }
 
-func (d *DB) Close() error {
-	d.log.Printf("closing")
-	return d.db.Close()
+// SetIdempotencyToken records the version of the event appended
+// with the given idempotency token. The record expires after ttl.
+func (t *Tx) SetIdempotencyToken(
+	token string,
+	version client.Version,
+	ttl time.Duration,
+) error {
+	return t.setWithTTL("idem_"+token, version, ttl)
 }
 
-// TxType defines a transaction type
-type TxType bool
+// GetIdempotencyToken returns the version recorded for the given
+// idempotency token. ok is false if no unexpired record exists.
+func (t *Tx) GetIdempotencyToken(token string) (
+	version client.Version,
+	ok bool,
+	err error,
+) {
+	if version, err = t.get("idem_" + token); err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return version, true, nil
+}
 
-const (
-	ReadOnly  TxType = false
-	ReadWrite TxType = true
-)
+// idemKeyPrefix prefixes the records of RecordIdempotencyKey, which are
+// kept apart from the tokens of SetIdempotencyToken.
+const idemKeyPrefix = "ik_"
 
-// WithinTx creates a new database transaction and executes fn within it.
-// The transaction is automatically commited if fn returns nil.
-func (d *DB) WithinTx(
-	tt TxType,
-	fn func(*Tx) error,
-) (err error) {
-	t := &Tx{tx: d.db.NewTransaction(bool(tt)), log: d.log}
-	defer func() {
+// DeleteIdempotencyToken deletes the record of the given
+// idempotency token.
+func (t *Tx) DeleteIdempotencyToken(token string) error {
+	return t.delete("idem_" + token)
+}
+
+// RecordIdempotencyKey records that the event at version recorded at
+// recordedAt carries the given idempotency key. duplicate is true if
+// the key was recorded for an event at a different version within the
+// retention set by WithIdempotencyKeyRetention before recordedAt,
+// in which case nothing is recorded. Since the retention is measured
+// between the times events were recorded, replaying the log yields
+// the same duplicates. Records expire once the retention elapsed.
+func (t *Tx) RecordIdempotencyKey(
+	key string,
+	version client.Version,
+	recordedAt time.Time,
+) (duplicate bool, err error) {
+	k := idemKeyPrefix + key
+	v, err := t.get(k)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+	case err != nil:
+		return false, err
+	default:
+		prevVersion, prevAt, ok := strings.Cut(v, " ")
+		if !ok {
+			return false, fmt.Errorf("malformed idempotency key record: %q", v)
+		}
+		if prevVersion == version {
+			return false, nil
+		}
+		n, err := strconv.ParseInt(prevAt, 10, 64)
 		if err != nil {
-			t.tx.Discard()
-			d.log.Printf("tx %p: discarded", t)
-			return
+			return false, fmt.Errorf("parsing idempotency key record: %w", err)
 		}
-		if err = t.tx.Commit(); err != nil {
-			return
+		if t.idemKeyRetention <= 0 ||
+			recordedAt.Sub(time.Unix(0, n)) < t.idemKeyRetention {
+			return true, nil
 		}
-		d.log.Printf("tx %p: commited", t)
-	}()
-	d.log.Printf("created tx %p", t)
-	return fn(t)
+	}
+	v = version + " " + strconv.FormatInt(recordedAt.UnixNano(), 10)
+	if t.idemKeyRetention <= 0 {
+		return false, t.set(k, v)
+	}
+	// The record must outlive the retention measured from recordedAt,
+	// which a TTL measured from now always does
+	return false, t.setWithTTL(k, v, t.idemKeyRetention)
 }
 
-// Tx is a database transaction.
-type Tx struct {
-	tx  *badger.Txn
-	log *log.Logger
-}
+// allCompanionPrefixes are the prefixes of all keys stored alongside
+// the "o_" key of an object. Locks aren't part of the object and remain
+// with the name they were acquired for (see DB.Lock).
+var allCompanionPrefixes = []string{"t_", "v_", "reserved_"}
 
-// Delete deletes an object from the database.
-func (t *Tx) Delete(object string) error {
-	return t.delete("o_" + object)
-}
+// Rename renames oldObject to newObject including all of its companion keys
+// and scheduled expiries. ErrNotFound is returned if oldObject isn't stored
+// and ErrAlreadyExists if newObject is already stored.
+func (t *Tx) Rename(oldObject, newObject string) error {
+	if ok, err := t.Has(oldObject); err != nil {
+		return err
+	} else if !ok {
+		return ErrNotFound
+	}
+	if ok, err := t.Has(newObject); err != nil {
+		return err
+	} else if ok {
+		return ErrAlreadyExists
+	}
 
-// Set updates an object entry in the database.
-func (t *Tx) Set(object string, num int64) error {
-	return t.set("o_"+object, fmt.Sprintf("%d", num))
-}
+	for _, p := range append([]string{"o_"}, allCompanionPrefixes...) {
+		if err := t.move(p+oldObject, p+newObject); err != nil {
+			return err
+		}
+	}
 
-// SetProjectionVersion changes the projection version of the database.
-func (t *Tx) SetProjectionVersion(version client.Version) error {
-	return t.set("version", version)
-}
+	type expiry struct {
+		quantity  int64
+		expiresAt time.Time
+	}
+	var expiries []expiry
+	if err := t.ScanExpired(
+		time.Unix(0, math.MaxInt64),
+		func(object string, quantity int64, expiresAt time.Time) error {
+			if object == oldObject {
+				expiries = append(expiries, expiry{quantity, expiresAt})
+			}
+			return nil
+		},
+	); err != nil {
+		return err
+	}
+	for _, x := range expiries {
+		if err := t.DeleteExpiry(oldObject, x.expiresAt); err != nil {
+			return err
+		}
+		if err := t.SetExpiry(newObject, x.quantity, x.expiresAt); err != nil {
+			return err
+		}
+	}
 
-// GetQuantity reads the stored quantity of a particular object type.
-func (t *Tx) GetQuantity(object string) (num int64, err error) {
-	v, err := t.get("o_" + object)
-	if err != nil {
-		if errors.Is(err, badger.ErrKeyNotFound) {
-			return 0, nil
+	reservations := map[string]int64{}
+	if err := t.scanReservations(func(
+		id, object string, quantity int64,
+	) error {
+		if object == oldObject {
+			reservations[id] = quantity
 		}
-		return 0, err
+		return nil
+	}); err != nil {
+		return err
 	}
-	return strconv.ParseInt(string(v), 10, 64)
+	for id, q := range reservations {
+		if err := t.SetReservation(id, newObject, q); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// GetProjectionVersion reads the projection version of the database.
-func (t *Tx) GetProjectionVersion() (client.Version, error) {
-	v, err := t.get("version")
+// move moves the value of oldKey to newKey preserving its expiry.
+// move is a no-op if oldKey doesn't exist.
+func (t *Tx) move(oldKey, newKey string) error {
+	i, err := t.tx.Get([]byte(oldKey))
 	if err != nil {
 		if errors.Is(err, badger.ErrKeyNotFound) {
-			return "", nil
+			return nil
 		}
-		return "", err
+		return err
 	}
-	return v, nil
+	v, err := i.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	e := badger.NewEntry([]byte(newKey), v)
+	e.ExpiresAt = i.ExpiresAt()
+	if err := t.tx.SetEntry(e); err != nil {
+		t.log.Error(
+			"moving",
+			slog.String("key", oldKey),
+			slog.String("new_key", newKey),
+			slog.Any("error", err),
+		)
+		return err
+	}
+	t.stats.KeysRead++
+	t.stats.BytesRead += int64(len(oldKey) + len(v))
+	t.stats.KeysWritten++
+	t.stats.BytesWritten += int64(len(newKey) + len(v))
+	t.record(newKey, string(v), false)
+	t.log.Debug(
+		"moved", slog.String("key", oldKey), slog.String("new_key", newKey),
+	)
+	return t.delete(oldKey)
 }
 
 // ScanObjects calls fn for each object scanned from the database.
 func (t *Tx) ScanObjects(fn func(object string, quantity int64) error) error {
-	return t.scanPrefix("o_", func(key, value string) error {
+	return t.ScanObjectsWithPrefix("", fn)
+}
+
+// ScanObjectsWithPrefix is similar to ScanObjects but only scans objects
+// whose name starts with prefix, which is stripped from the names
+// passed to fn.
+func (t *Tx) ScanObjectsWithPrefix(
+	prefix string,
+	fn func(object string, quantity int64) error,
+) error {
+	p := "o_" + prefix
+	return t.scanPrefix(p, func(key, value string) error {
+		q, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing scanned quantity: %w", err)
+		}
+		return fn(key[len(p):], q)
+	})
+}
+
+// GetAll returns the quantities of all objects stored in the database.
+// An empty map is returned for an empty database.
+func (t *Tx) GetAll() (map[string]int64, error) {
+	all := map[string]int64{}
+	if err := t.ScanObjects(func(object string, quantity int64) error {
+		all[object] = quantity
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// SortOrder is the order objects are scanned in by Tx.ScanObjectsSorted.
+type SortOrder int
+
+const (
+	// SortByQuantityDesc scans objects with the highest quantity first.
+	SortByQuantityDesc SortOrder = iota
+
+	// SortByQuantityAsc scans objects with the lowest quantity first.
+	SortByQuantityAsc
+)
+
+// ScanObjectsSorted is similar to ScanObjects but calls fn for each object
+// in the given order. Objects of equal quantity are scanned in
+// lexicographical order. Since the database isn't sorted by quantity
+// all objects are read into memory and sorted before fn is called.
+func (t *Tx) ScanObjectsSorted(
+	order SortOrder,
+	fn func(object string, quantity int64) error,
+) error {
+	type entry struct {
+		object   string
+		quantity int64
+	}
+	var entries []entry
+	if err := t.ScanObjects(func(object string, quantity int64) error {
+		entries = append(entries, entry{object, quantity})
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if order == SortByQuantityAsc {
+			return entries[i].quantity < entries[j].quantity
+		}
+		return entries[i].quantity > entries[j].quantity
+	})
+	for _, e := range entries {
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(e.object, e.quantity); err != nil {
+			if err == ErrAbortScan {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanObjectsFrom is similar to ScanObjects but starts at object cursor
+// and calls fn for at most limit objects. An empty cursor starts
+// at the first object and a limit below 1 disables the limit.
+// nextCursor is the object the next page starts at and is empty
+// if there are no more objects.
+func (t *Tx) ScanObjectsFrom(
+	cursor string,
+	limit int,
+	fn func(object string, quantity int64) error,
+) (nextCursor string, err error) {
+	p := []byte("o_")
+	i := t.tx.NewIterator(badger.DefaultIteratorOptions)
+	defer i.Close()
+
+	count := 0
+	for i.Seek([]byte("o_" + cursor)); i.ValidForPrefix(p); i.Next() {
+		if err := t.ctx.Err(); err != nil {
+			return "", err
+		}
+		item := i.Item()
+		object := string(item.Key()[len(p):])
+		if limit > 0 && count >= limit {
+			return object, nil
+		}
+		count++
+		t.stats.KeysRead++
+		t.stats.BytesRead += int64(len(item.Key())) + item.ValueSize()
+		if err = item.Value(func(v []byte) error {
+			q, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return fmt.Errorf("parsing scanned quantity: %w", err)
+			}
+			return fn(object, q)
+		}); err != nil {
+			if err == ErrAbortScan {
+				return "", nil
+			}
+			return "", err
+		}
+	}
+	t.log.Debug(
+		"scanned objects",
+		slog.Int("count", count), slog.String("cursor", cursor),
+	)
+	return "", nil
+}
+
+// SetExpiry schedules the given quantity of object to expire at expiresAt.
+func (t *Tx) SetExpiry(
+	object string,
+	quantity int64,
+	expiresAt time.Time,
+) error {
+	return t.set(expiryKey(object, expiresAt), fmt.Sprintf("%d", quantity))
+}
+
+// DeleteExpiry deletes the expiry entry of object scheduled at expiresAt.
+func (t *Tx) DeleteExpiry(object string, expiresAt time.Time) error {
+	return t.delete(expiryKey(object, expiresAt))
+}
+
+// HasExpiry returns true if an expiry entry of object
+// is scheduled at expiresAt.
+func (t *Tx) HasExpiry(object string, expiresAt time.Time) (bool, error) {
+	return t.has(expiryKey(object, expiresAt))
+}
+
+// ScanExpired calls fn for each expiry entry scheduled before the given time
+// in chronological order.
+func (t *Tx) ScanExpired(
+	before time.Time,
+	fn func(object string, quantity int64, expiresAt time.Time) error,
+) error {
+	return t.scanPrefix("x_", func(key, value string) error {
+		// Key format: x_<unix nanoseconds>_<object>
+		k := key[len("x_"):]
+		if len(k) <= timeKeyLen {
+			return fmt.Errorf("malformed expiry key: %q", key)
+		}
+		nanos, err := strconv.ParseInt(k[:timeKeyLen], 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing scanned expiry time: %w", err)
+		}
+		expiresAt := time.Unix(0, nanos)
+		if !expiresAt.Before(before) {
+			return ErrAbortScan
+		}
 		q, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
 			return fmt.Errorf("parsing scanned quantity: %w", err)
 		}
-		return fn(key[len("o_"):], q)
+		return fn(k[timeKeyLen+1:], q, expiresAt)
+	})
+}
+
+// objectCountKey is the key of the object counter and prefixes the keys
+// of the deltas recorded by transactions that weren't folded into it yet.
+const (
+	objectCountKey         = "object_count"
+	objectCountDeltaPrefix = objectCountKey + "_d_"
+)
+
+// objectCountFoldLimit is the number of object count deltas
+// at which ObjectCount folds them into the counter.
+const objectCountFoldLimit = 1000
+
+// objectDeltaKey returns a new unique object count delta key.
+func (d *DB) objectDeltaKey() string {
+	return fmt.Sprintf(
+		"%s%020d_%d",
+		objectCountDeltaPrefix, time.Now().UnixNano(), d.objectDeltaSeq.Add(1),
+	)
+}
+
+// objectCounter is the state of the object counter.
+type objectCounter struct {
+	// initialized is false if the counter was never written
+	initialized bool
+	base        int64
+	deltaSum    int64
+	deltaKeys   []string
+}
+
+func (c objectCounter) count() int64 { return c.base + c.deltaSum }
+
+// readObjectCounter reads the object counter and all deltas
+// including the one of this transaction.
+func (t *Tx) readObjectCounter() (c objectCounter, err error) {
+	v, err := t.get(objectCountKey)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+	case err != nil:
+		return objectCounter{}, err
+	default:
+		c.initialized = true
+		if c.base, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return objectCounter{}, fmt.Errorf("parsing object count: %w", err)
+		}
+	}
+	err = t.scanPrefix(objectCountDeltaPrefix, func(key, value string) error {
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing object count delta %q: %w", key, err)
+		}
+		c.deltaSum += d
+		c.deltaKeys = append(c.deltaKeys, key)
+		return nil
 	})
+	if err != nil {
+		return objectCounter{}, err
+	}
+	c.deltaSum += t.objectDelta
+	return c, nil
+}
+
+// foldObjectCount adds the deltas to the object counter and deletes them.
+// Deltas recorded by concurrent transactions aren't read and therefore
+// don't conflict with the fold.
+func (t *Tx) foldObjectCount() error {
+	c, err := t.readObjectCounter()
+	if err != nil {
+		return err
+	}
+	return t.writeObjectCount(c.count(), c.deltaKeys)
+}
+
+// resetObjectCount overwrites the object counter with count
+// and deletes all deltas including malformed ones.
+func (t *Tx) resetObjectCount(count int64) error {
+	var deltaKeys []string
+	if err := t.scanPrefix(objectCountDeltaPrefix, func(key, _ string) error {
+		deltaKeys = append(deltaKeys, key)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return t.writeObjectCount(count, deltaKeys)
+}
+
+func (t *Tx) writeObjectCount(count int64, deltaKeys []string) error {
+	for _, k := range deltaKeys {
+		if err := t.delete(k); err != nil {
+			return err
+		}
+	}
+	// The delta of this transaction is part of count
+	t.objectDelta = 0
+	return t.set(objectCountKey, strconv.FormatInt(count, 10))
+}
+
+// countObjects counts the stored objects without reading their values.
+func (t *Tx) countObjects(ctx context.Context) (count int64, err error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte("o_")
+	i := t.tx.NewIterator(opts)
+	defer i.Close()
+	for i.Rewind(); i.Valid(); i.Next() {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	t.stats.KeysRead += count
+	return count, nil
+}
+
+// timeKeyLen is the length of the zero-padded time
+// in expiry and version history keys.
+const timeKeyLen = 20
+
+func expiryKey(object string, expiresAt time.Time) string {
+	return fmt.Sprintf("x_%020d_%s", expiresAt.UnixNano(), object)
+}
+
+func (t *Tx) checkIntegrity(
+	ctx context.Context,
+	fix bool,
+) (issues []IntegrityError, err error) {
+	objects := map[string]struct{}{}
+	var timestamps, versions []string
+	if err := t.scanPrefix("", func(key, value string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(key, "o_"):
+			objects[key[len("o_"):]] = struct{}{}
+			q, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				issues = append(issues, IntegrityError{
+					Key:   key,
+					Issue: fmt.Sprintf("malformed quantity: %q", value),
+				})
+			} else if q < 1 {
+				issues = append(issues, IntegrityError{
+					Key:   key,
+					Issue: fmt.Sprintf("non-positive quantity: %d", q),
+				})
+			}
+		case strings.HasPrefix(key, "t_"):
+			timestamps = append(timestamps, key)
+		case strings.HasPrefix(key, "v_"):
+			versions = append(versions, key)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, k := range timestamps {
+		if _, ok := objects[k[len("t_"):]]; ok {
+			continue
+		}
+		issues = append(issues, IntegrityError{
+			Key:   k,
+			Issue: "orphaned timestamp",
+		})
+		if fix {
+			if err := t.delete(k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, k := range versions {
+		if _, ok := objects[k[len("v_"):]]; ok {
+			continue
+		}
+		issues = append(issues, IntegrityError{
+			Key:   k,
+			Issue: "orphaned object version",
+		})
+		if fix {
+			if err := t.delete(k); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	c, err := t.readObjectCounter()
+	if err != nil {
+		issues = append(issues, IntegrityError{
+			Key:   objectCountKey,
+			Issue: err.Error(),
+		})
+	}
+	if n := int64(len(objects)); err != nil || c.count() != n {
+		if err == nil {
+			issues = append(issues, IntegrityError{
+				Key: objectCountKey,
+				Issue: fmt.Sprintf(
+					"counter is %d, found %d objects", c.count(), n,
+				),
+			})
+		}
+		if fix {
+			if err := t.resetObjectCount(n); err != nil {
+				return nil, err
+			}
+		}
+	} else if fix && len(c.deltaKeys) > 0 {
+		if err := t.writeObjectCount(n, c.deltaKeys); err != nil {
+			return nil, err
+		}
+	}
+
+	v, err := t.GetProjectionVersion()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case v == "" && len(objects) > 0:
+		issues = append(issues, IntegrityError{
+			Key:   "version",
+			Issue: "missing projection version",
+		})
+	case v != "" && len(objects) < 1 && fix:
+		if err := t.delete("version"); err != nil {
+			return nil, err
+		}
+	}
+	return issues, nil
 }
 
 func (t *Tx) get(key string) (value string, err error) {
 	i, err := t.tx.Get([]byte(key))
 	if err != nil {
 		if errors.Is(err, badger.ErrKeyNotFound) {
-			t.log.Printf("tx %p: getting %q: not found", t, key)
+			t.log.Debug("getting: not found", slog.String("key", key))
 		} else {
-			t.log.Printf("tx %p: getting %q: %s", t, key, err)
+			t.log.Error(
+				"getting", slog.String("key", key), slog.Any("error", err),
+			)
 		}
 		return "", err
 	}
@@ -138,28 +1850,77 @@ func (t *Tx) get(key string) (value string, err error) {
 		value = string(v)
 		return nil
 	}); err != nil {
-		t.log.Printf("tx %p: getting %q: reading value: %s", t, key, err)
+		t.log.Error(
+			"getting: reading value",
+			slog.String("key", key), slog.Any("error", err),
+		)
 		return "", err
 	}
-	t.log.Printf("tx %p: getting %q: %q", t, key, value)
+	t.stats.KeysRead++
+	t.stats.BytesRead += int64(len(key) + len(value))
+	t.log.Debug("get", slog.String("key", key), slog.String("value", value))
 	return value, nil
 }
 
+func (t *Tx) has(key string) (bool, error) {
+	if _, err := t.tx.Get([]byte(key)); err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return false, nil
+		}
+		t.log.Error(
+			"checking", slog.String("key", key), slog.Any("error", err),
+		)
+		return false, err
+	}
+	return true, nil
+}
+
 func (t *Tx) set(key, value string) error {
 	if err := t.tx.Set([]byte(key), []byte(value)); err != nil {
-		t.log.Printf("tx %p: setting %q -> %q: %s", t, key, value, err)
+		t.log.Error(
+			"setting", slog.String("key", key), slog.Any("error", err),
+		)
+		return err
+	}
+	t.stats.KeysWritten++
+	t.stats.BytesWritten += int64(len(key) + len(value))
+	t.record(key, value, false)
+	t.log.Debug("set", slog.String("key", key), slog.String("value", value))
+	return nil
+}
+
+func (t *Tx) setWithTTL(key, value string, ttl time.Duration) error {
+	if err := t.tx.SetEntry(
+		badger.NewEntry([]byte(key), []byte(value)).WithTTL(ttl),
+	); err != nil {
+		t.log.Error(
+			"setting", slog.String("key", key), slog.Any("error", err),
+		)
 		return err
 	}
-	t.log.Printf("tx %p: set %q -> %q", t, key, value)
+	t.stats.KeysWritten++
+	t.stats.BytesWritten += int64(len(key) + len(value))
+	t.record(key, value, false)
+	t.log.Debug(
+		"set",
+		slog.String("key", key),
+		slog.String("value", value),
+		slog.Duration("ttl", ttl),
+	)
 	return nil
 }
 
 func (t *Tx) delete(key string) error {
 	if err := t.tx.Delete([]byte(key)); err != nil {
-		t.log.Printf("tx %p: deleting %q: %s", t, key, err)
+		t.log.Error(
+			"deleting", slog.String("key", key), slog.Any("error", err),
+		)
 		return err
 	}
-	t.log.Printf("tx %p: deleted %q", t, key)
+	t.stats.KeysWritten++
+	t.stats.BytesWritten += int64(len(key))
+	t.record(key, "", true)
+	t.log.Debug("deleted", slog.String("key", key))
 	return nil
 }
 
@@ -173,26 +1934,62 @@ func (t *Tx) scanPrefix(
 
 	count := 0
 	for i.Seek(p); i.ValidForPrefix(p); i.Next() {
+		if err = t.ctx.Err(); err != nil {
+			break
+		}
 		count++
 		i := i.Item()
-		if err := i.Value(func(v []byte) error {
-			t.log.Printf(
-				"tx %p: scanned %q = %q", t, string(i.Key()), string(v),
+		t.stats.KeysRead++
+		t.stats.BytesRead += int64(len(i.Key())) + i.ValueSize()
+		if err = i.Value(func(v []byte) error {
+			t.log.Debug(
+				"scanned",
+				slog.String("key", string(i.Key())),
+				slog.String("value", string(v)),
 			)
 			return fn(string(i.Key()), string(v))
 		}); err != nil {
-			t.log.Printf(
-				"tx %p: reading value of %q: %s", t, string(i.Key()), err,
-			)
-			return err
+			if err != ErrAbortScan {
+				t.log.Error(
+					"reading value",
+					slog.String("key", string(i.Key())),
+					slog.Any("error", err),
+				)
+			}
+			break
 		}
 	}
 	if err != nil && err != ErrAbortScan {
 		return err
 	}
-	t.log.Printf("tx %p: scanned %d key-value pairs", t, count)
+	t.log.Debug(
+		"scanned key-value pairs",
+		slog.String("prefix", prefix), slog.Int("count", count),
+	)
 	return nil
 }
 
+// CompareVersions compares the hexadecimal event log versions a and b
+// returning -1 if a < b, 0 if a == b and 1 if a > b.
+// An empty version is lower than any other version.
+func CompareVersions(a, b client.Version) int {
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
 var ErrAbortScan = errors.New("abort scan")
 var ErrNotFound = errors.New("not found")
+var ErrAlreadyExists = errors.New("already exists")
+var ErrDatabaseSealed = errors.New("database sealed")
+var ErrNotSealed = errors.New("database not sealed")
+var ErrReadOnlyDatabase = errors.New("database is read-only")
+var ErrDebugModeDisabled = errors.New("debug mode disabled")
+
+// ErrConflict is returned by read-write transactions that conflict with
+// a concurrently committed transaction.
+var ErrConflict = badger.ErrConflict
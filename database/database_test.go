@@ -0,0 +1,506 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// newTestDB returns an in-memory database.
+func newTestDB(t *testing.T, opts ...Option) *DB {
+	t.Helper()
+	db, err := Open("", slog.New(slog.NewTextHandler(io.Discard, nil)), opts...)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestVersionHistoryRecordedPerTransaction(t *testing.T) {
+	db := newTestDB(t, WithVersionHistoryLimit(3))
+
+	for i := 1; i <= 5; i++ {
+		err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+			// Only the last version of the transaction is recorded
+			for j := 0; j < 10; j++ {
+				v := fmt.Sprintf("%d_%d", i, j)
+				if err := tx.SetProjectionVersion(v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("setting version: %v", err)
+		}
+	}
+
+	var records []VersionRecord
+	if err := db.WithinTx(ReadOnly, func(tx *Tx) (err error) {
+		records, err = tx.GetProjectionVersionHistory()
+		return err
+	}); err != nil {
+		t.Fatalf("reading history: %v", err)
+	}
+	want := []string{"3_9", "4_9", "5_9"}
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, got %#v", len(want), records)
+	}
+	for i, r := range records {
+		if r.Version != want[i] {
+			t.Errorf("expected record %d to be %q, got %q",
+				i, want[i], r.Version)
+		}
+	}
+}
+
+func TestGetVersionOrZero(t *testing.T) {
+	db := newTestDB(t)
+
+	err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		v, err := tx.GetVersionOrZero()
+		if err != nil {
+			return err
+		}
+		if v != "" {
+			t.Errorf("expected zero version, got %q", v)
+		}
+		if err := tx.SetProjectionVersion("0a"); err != nil {
+			return err
+		}
+		if v, err = tx.GetVersionOrZero(); err != nil {
+			return err
+		}
+		if v != "0a" {
+			t.Errorf("expected version 0a, got %q", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObjectCount(t *testing.T) {
+	db := newTestDB(t)
+
+	err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		for _, o := range []string{"apple", "pear", "kiwi"} {
+			if err := tx.Set(o, 1); err != nil {
+				return err
+			}
+		}
+		// Overwriting an object doesn't change the count
+		if err := tx.Set("apple", 2); err != nil {
+			return err
+		}
+		return tx.Delete("kiwi")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.ObjectCount(); err != nil {
+		t.Fatalf("counting objects: %v", err)
+	} else if n != 2 {
+		t.Fatalf("expected 2 objects, got %d", n)
+	}
+
+	// Transactions creating objects concurrently don't conflict
+	var written sync.WaitGroup
+	written.Add(2)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			errs <- db.WithinTx(ReadWrite, func(tx *Tx) error {
+				err := tx.Set(fmt.Sprintf("new_%d", i), 1)
+				written.Done()
+				written.Wait()
+				return err
+			})
+		}(i)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("committing: %v", err)
+		}
+	}
+	if n, err := db.ObjectCount(); err != nil {
+		t.Fatalf("counting objects: %v", err)
+	} else if n != 4 {
+		t.Fatalf("expected 4 objects, got %d", n)
+	}
+}
+
+func TestObjectCountFold(t *testing.T) {
+	db := newTestDB(t)
+	const n = objectCountFoldLimit + 1
+	for i := 0; i < n; i++ {
+		if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+			return tx.Set(fmt.Sprintf("o%d", i), 1)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// Initialize the counter
+			if _, err := db.ObjectCount(); err != nil {
+				t.Fatalf("counting objects: %v", err)
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if c, err := db.ObjectCount(); err != nil {
+			t.Fatalf("counting objects: %v", err)
+		} else if c != n {
+			t.Fatalf("expected %d objects, got %d", n, c)
+		}
+	}
+	err := db.WithinTx(ReadOnly, func(tx *Tx) error {
+		c, err := tx.readObjectCounter()
+		if err == nil && len(c.deltaKeys) > 0 {
+			t.Errorf("expected the deltas to be folded, got %d",
+				len(c.deltaKeys))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObjectCountDrift(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		if err := tx.BatchSet(map[string]int64{"a": 1, "b": 2}); err != nil {
+			return err
+		}
+		return tx.SetProjectionVersion("0a")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.ObjectCount(); err != nil || n != 2 {
+		t.Fatalf("expected 2 objects, got %d (%v)", n, err)
+	}
+
+	// Simulate a delta lost by a crash
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.set(objectCountKey, "5")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	issues, err := db.CheckIntegrity(ctx)
+	if err != nil {
+		t.Fatalf("checking integrity: %v", err)
+	}
+	if len(issues) != 1 || issues[0].Key != objectCountKey {
+		t.Fatalf("expected a drifted counter, got %v", issues)
+	}
+	if _, err := db.FixIntegrity(ctx); err != nil {
+		t.Fatalf("fixing integrity: %v", err)
+	}
+	if n, err := db.ObjectCount(); err != nil || n != 2 {
+		t.Fatalf("expected 2 objects, got %d (%v)", n, err)
+	}
+
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.set(objectCountKey, "7")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.RecalculateObjectCount(ctx); err != nil || n != 2 {
+		t.Fatalf("expected 2 objects, got %d (%v)", n, err)
+	}
+	if n, err := db.ObjectCount(); err != nil || n != 2 {
+		t.Fatalf("expected 2 objects, got %d (%v)", n, err)
+	}
+}
+
+func TestRenameMovesCompanionKeys(t *testing.T) {
+	db := newTestDB(t, WithStrictConsistencyChecks(true))
+	expiresAt := time.Unix(100, 0)
+
+	err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		if err := tx.SetWithVersion("apple", 5, "0a"); err != nil {
+			return err
+		}
+		if err := tx.set("lock_apple", "1"); err != nil {
+			return err
+		}
+		if err := tx.SetReserved("apple", 2); err != nil {
+			return err
+		}
+		if err := tx.SetReservation("r1", "apple", 2); err != nil {
+			return err
+		}
+		return tx.SetExpiry("apple", 1, expiresAt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var before map[string]string
+	if err := db.WithinTx(ReadOnly, func(tx *Tx) (err error) {
+		before, err = companionValues(tx, "apple")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 1+len(allCompanionPrefixes) {
+		t.Fatalf("expected all companion keys to be set, got %v", before)
+	}
+
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.Rename("apple", "pear")
+	}); err != nil {
+		t.Fatalf("renaming: %v", err)
+	}
+
+	err = db.WithinTx(ReadOnly, func(tx *Tx) error {
+		if old, err := companionValues(tx, "apple"); err != nil {
+			return err
+		} else if len(old) > 0 {
+			t.Errorf("old keys remain: %v", old)
+		}
+		// Locks remain with the name they were acquired for
+		if ok, err := tx.has("lock_apple"); err != nil {
+			return err
+		} else if !ok {
+			t.Errorf("lock moved")
+		}
+		moved, err := companionValues(tx, "pear")
+		if err != nil {
+			return err
+		}
+		for p, v := range before {
+			if moved[p] != v {
+				t.Errorf("expected %spear to be %q, got %q", p, v, moved[p])
+			}
+		}
+		if ok, err := tx.HasExpiry("pear", expiresAt); err != nil {
+			return err
+		} else if !ok {
+			t.Errorf("expiry not moved")
+		}
+		object, q, ok, err := tx.GetReservation("r1")
+		if err != nil {
+			return err
+		}
+		if !ok || object != "pear" || q != 2 {
+			t.Errorf("reservation not moved: %q %d %t", object, q, ok)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Renaming onto an existing object fails
+	err = db.WithinTx(ReadWrite, func(tx *Tx) error {
+		if err := tx.Set("kiwi", 1); err != nil {
+			return err
+		}
+		return tx.Rename("pear", "kiwi")
+	})
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists, got %v", err)
+	}
+}
+
+// companionValues returns the values of the "o_" key and all companion keys
+// of object mapped by their prefixes.
+func companionValues(tx *Tx, object string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, p := range append([]string{"o_"}, allCompanionPrefixes...) {
+		v, err := tx.get(p + object)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[p] = v
+	}
+	return values, nil
+}
+
+func TestBatchSetAtomic(t *testing.T) {
+	db := newTestDB(t)
+
+	// Objects are written in lexicographical order, so the write
+	// of the oversized object fails after "a" was written
+	tooLong := "b" + strings.Repeat("x", 1<<16)
+	err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.BatchSet(map[string]int64{"a": 1, tooLong: 2, "c": 3})
+	})
+	if err == nil {
+		t.Fatalf("expected writing an oversized key to fail")
+	}
+	err = db.WithinTx(ReadOnly, func(tx *Tx) error {
+		all, err := tx.GetAll()
+		if err == nil && len(all) > 0 {
+			t.Errorf("expected the batch to be discarded, got %v", all)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int64{"a": 1, "b": 2, "c": 3}
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.BatchSet(want)
+	}); err != nil {
+		t.Fatalf("setting batch: %v", err)
+	}
+	err = db.WithinTx(ReadWrite, func(tx *Tx) error {
+		if err := tx.BatchDelete([]string{"a", "c"}); err != nil {
+			return err
+		}
+		return errors.New("discard")
+	})
+	if err == nil || err.Error() != "discard" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = db.WithinTx(ReadOnly, func(tx *Tx) error {
+		all, err := tx.GetAll()
+		if err == nil && len(all) != len(want) {
+			t.Errorf("expected the deletions to be discarded, got %v", all)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.BatchDelete([]string{"a", "c"})
+	}); err != nil {
+		t.Fatalf("deleting batch: %v", err)
+	}
+	err = db.WithinTx(ReadOnly, func(tx *Tx) error {
+		all, err := tx.GetAll()
+		if err == nil && (len(all) != 1 || all["b"] != 2) {
+			t.Errorf("expected only b to remain, got %v", all)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	db := newTestDB(t)
+
+	err := db.WithinTx(ReadOnly, func(tx *Tx) error {
+		all, err := tx.GetAll()
+		if err != nil {
+			return err
+		}
+		if all == nil || len(all) != 0 {
+			t.Errorf("expected an empty non-nil map, got %#v", all)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int64{
+		"apple": 1, "pear": 2, "kiwi": 3, "plum": 4, "fig": 5,
+	}
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.BatchSet(want)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err = db.WithinTx(ReadOnly, func(tx *Tx) error {
+		all, err := tx.GetAll()
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(all, want) {
+			t.Errorf("expected %v, got %v", want, all)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanObjectsWithPrefix(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.BatchSet(map[string]int64{
+			"widget": 1, "gadget_x": 2, "gadget_y": 3,
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]int64{}
+	err := db.WithinTx(ReadOnly, func(tx *Tx) error {
+		return tx.ScanObjectsWithPrefix(
+			"gadget_", func(object string, quantity int64) error {
+				got[object] = quantity
+				return nil
+			},
+		)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"x": 2, "y": 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestWithinTxContextCanceledMidScan(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.BatchSet(map[string]int64{"a": 1, "b": 2, "c": 3})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scanned := 0
+	err := db.WithinTxContext(ctx, ReadWrite, func(tx *Tx) error {
+		if err := tx.Set("d", 4); err != nil {
+			return err
+		}
+		return tx.ScanObjects(func(object string, quantity int64) error {
+			scanned++
+			cancel()
+			return nil
+		})
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if scanned != 1 {
+		t.Fatalf("expected the scan to stop after 1 object, got %d", scanned)
+	}
+	err = db.WithinTx(ReadOnly, func(tx *Tx) error {
+		ok, err := tx.Has("d")
+		if err == nil && ok {
+			t.Errorf("the canceled transaction was committed")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
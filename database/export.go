@@ -0,0 +1,79 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/romshark/eventlog/client"
+)
+
+// jsonRecord is a line of the format written by DB.ExportJSON,
+// which is either an object or the final version record.
+type jsonRecord struct {
+	Object   *string         `json:"object,omitempty"`
+	Quantity int64           `json:"quantity,omitempty"`
+	Version  *client.Version `json:"version,omitempty"`
+}
+
+// ExportJSON writes all objects to w as newline-delimited JSON records
+// of the form {"object":"...","quantity":...} followed by a final
+// {"version":"..."} record containing the projection version.
+func (d *DB) ExportJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return d.WithinTx(ReadOnly, func(tx *Tx) error {
+		v, err := tx.GetProjectionVersion()
+		if err != nil {
+			return err
+		}
+		if err := tx.ScanObjects(func(object string, quantity int64) error {
+			return enc.Encode(jsonRecord{Object: &object, Quantity: quantity})
+		}); err != nil {
+			return err
+		}
+		return enc.Encode(jsonRecord{Version: &v})
+	})
+}
+
+// ImportJSON replaces all objects and the projection version with
+// the records read from r in the format written by ExportJSON within
+// a single transaction. ErrMalformedExport is returned if the version
+// record is missing or isn't the last record.
+func (d *DB) ImportJSON(r io.Reader) error {
+	objects := map[string]int64{}
+	var version *client.Version
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var rec jsonRecord
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("decoding record %d: %w", line, err)
+		}
+		switch {
+		case version != nil:
+			return fmt.Errorf(
+				"%w: record %d follows the version record",
+				ErrMalformedExport, line,
+			)
+		case rec.Version != nil:
+			version = rec.Version
+		case rec.Object != nil:
+			objects[*rec.Object] = rec.Quantity
+		default:
+			return fmt.Errorf(
+				"%w: record %d is empty", ErrMalformedExport, line,
+			)
+		}
+	}
+	if version == nil {
+		return fmt.Errorf("%w: missing version record", ErrMalformedExport)
+	}
+	return d.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.SetProjectionVersionBatch(*version, objects)
+	})
+}
+
+var ErrMalformedExport = errors.New("malformed export")
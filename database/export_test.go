@@ -0,0 +1,71 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportImportJSONRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+	want := map[string]int64{"apple": 3, "pear": 1, "kiwi": 42}
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.SetProjectionVersionBatch("0c", want)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.ExportJSON(&buf); err != nil {
+		t.Fatalf("exporting: %v", err)
+	}
+	if err := db.Reset(); err != nil {
+		t.Fatalf("wiping: %v", err)
+	}
+	if err := db.ImportJSON(&buf); err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+
+	err := db.WithinTx(ReadOnly, func(tx *Tx) error {
+		got := map[string]int64{}
+		if err := tx.ScanObjects(func(object string, q int64) error {
+			got[object] = q
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+		v, err := tx.GetProjectionVersion()
+		if err != nil {
+			return err
+		}
+		if v != "0c" {
+			t.Errorf("expected version 0c, got %q", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportJSONMalformed(t *testing.T) {
+	for name, input := range map[string]string{
+		"missing version": `{"object":"apple","quantity":1}` + "\n",
+		"version not last": `{"version":"0a"}` + "\n" +
+			`{"object":"apple","quantity":1}` + "\n",
+		"empty record": `{}` + "\n" + `{"version":"0a"}` + "\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := newTestDB(t)
+			err := db.ImportJSON(strings.NewReader(input))
+			if !errors.Is(err, ErrMalformedExport) {
+				t.Fatalf("expected ErrMalformedExport, got %v", err)
+			}
+		})
+	}
+}
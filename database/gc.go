@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// gcDiscardRatio is the discard ratio value log GC is run with.
+const gcDiscardRatio = 0.7
+
+// RunPeriodicGC runs value log garbage collection in the background every
+// interval until either ctx is canceled or the returned stop function
+// is called. stopFn blocks until the background goroutine has exited.
+// Garbage collection isn't run for in-memory databases.
+func (d *DB) RunPeriodicGC(
+	ctx context.Context,
+	interval time.Duration,
+) (stopFn func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			err := d.runGC(gcDiscardRatio)
+			switch {
+			case err == nil:
+				d.log.Info("value log GC: rewrote a value log file")
+			case errors.Is(err, badger.ErrNoRewrite):
+				d.log.Debug("value log GC: nothing to rewrite")
+			case errors.Is(err, badger.ErrGCInMemoryMode):
+				d.log.Info("value log GC: disabled for in-memory database")
+				return
+			default:
+				d.log.Error("value log GC", slog.Any("error", err))
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// GCStats are value log garbage collection statistics.
+type GCStats struct {
+	RunCount uint64
+
+	// BytesReclaimed is the approximate number of bytes reclaimed
+	// based on the value log size, which badger only updates periodically.
+	BytesReclaimed int64
+
+	LastGCAt       time.Time
+	LastGCDuration time.Duration
+}
+
+// GCStats returns the value log garbage collection statistics.
+func (d *DB) GCStats() (GCStats, error) {
+	d.gcStatsLock.Lock()
+	defer d.gcStatsLock.Unlock()
+	return d.gcStats, nil
+}
+
+// TriggerGC runs value log garbage collection once rewriting a value log
+// file if at least discardRatio of it can be discarded. ErrNoGCNeeded is
+// returned if no file was rewritten.
+func (d *DB) TriggerGC(discardRatio float64) error {
+	err := d.runGC(discardRatio)
+	if errors.Is(err, badger.ErrNoRewrite) {
+		return ErrNoGCNeeded
+	}
+	return err
+}
+
+// ErrNoGCNeeded is returned by TriggerGC if no value log file
+// contained enough discardable data to be rewritten.
+var ErrNoGCNeeded = errors.New("no value log GC needed")
+
+// runGC runs value log garbage collection once and updates the statistics.
+func (d *DB) runGC(discardRatio float64) error {
+	_, before := d.db.Size()
+	start := time.Now()
+	err := d.db.RunValueLogGC(discardRatio)
+	if errors.Is(err, badger.ErrGCInMemoryMode) {
+		return err
+	}
+	_, after := d.db.Size()
+
+	d.gcStatsLock.Lock()
+	defer d.gcStatsLock.Unlock()
+	d.gcStats.RunCount++
+	d.gcStats.LastGCAt = start
+	d.gcStats.LastGCDuration = time.Since(start)
+	if before > after {
+		d.gcStats.BytesReclaimed += before - after
+	}
+	return err
+}
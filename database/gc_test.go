@@ -0,0 +1,38 @@
+package database
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestGCStats(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db, err := Open(t.TempDir(), l)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	defer db.Close()
+
+	if s, err := db.GCStats(); err != nil {
+		t.Fatalf("reading GC stats: %v", err)
+	} else if s.RunCount != 0 {
+		t.Fatalf("expected no GC runs, got %d", s.RunCount)
+	}
+
+	err = db.TriggerGC(0.5)
+	if err != nil && !errors.Is(err, ErrNoGCNeeded) {
+		t.Fatalf("running GC: %v", err)
+	}
+	s, err := db.GCStats()
+	if err != nil {
+		t.Fatalf("reading GC stats: %v", err)
+	}
+	if s.RunCount < 1 {
+		t.Fatalf("expected at least one GC run, got %d", s.RunCount)
+	}
+	if s.LastGCAt.IsZero() {
+		t.Fatalf("expected the time of the last GC run to be recorded")
+	}
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// IteratorCursor iterates over the keys of a read-only transaction
+// in lexicographical order.
+type IteratorCursor struct {
+	ctx     context.Context
+	it      *badger.Iterator
+	prefix  []byte
+	started bool
+	err     error
+}
+
+// Seek positions the cursor at the first key starting with prefix
+// and restricts the iteration to keys starting with prefix.
+func (c *IteratorCursor) Seek(prefix string) {
+	c.prefix = []byte(prefix)
+	c.it.Seek(c.prefix)
+	c.started = true
+}
+
+// Next returns the key and value the cursor is positioned at
+// and advances the cursor. ok is false once there are no more keys,
+// ctx was canceled or reading a value failed.
+func (c *IteratorCursor) Next() (key, value string, ok bool) {
+	if c.err != nil {
+		return "", "", false
+	}
+	if c.err = c.ctx.Err(); c.err != nil {
+		return "", "", false
+	}
+	if !c.started {
+		c.it.Rewind()
+		c.started = true
+	}
+	if !c.it.ValidForPrefix(c.prefix) {
+		return "", "", false
+	}
+	i := c.it.Item()
+	v, err := i.ValueCopy(nil)
+	if err != nil {
+		c.err = err
+		return "", "", false
+	}
+	key = string(i.Key())
+	c.it.Next()
+	return key, string(v), true
+}
+
+// TransactionalIterator calls fn with a cursor over all keys of a new
+// read-only transaction. The cursor and the transaction are closed after
+// fn returns. If fn returns nil, the error the iteration failed with
+// is returned, if any.
+func (d *DB) TransactionalIterator(
+	ctx context.Context,
+	fn func(*IteratorCursor) error,
+) error {
+	return d.WithinTxContext(ctx, ReadOnly, func(tx *Tx) error {
+		it := tx.tx.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		c := &IteratorCursor{ctx: ctx, it: it}
+		if err := fn(c); err != nil {
+			return err
+		}
+		return c.err
+	})
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// WithLockTimeout sets the duration after which object locks acquired
+// by DB.Lock expire unless released. The default timeout is 30 seconds.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(d *DB) { d.lockTimeout = timeout }
+}
+
+// UnlockFn releases an object lock.
+type UnlockFn func() error
+
+// Lock acquires an advisory lock on object retrying until either the lock
+// is acquired or ctx is canceled. The lock expires after the lock timeout
+// unless released by the returned function before. Releasing a lock that
+// expired and was acquired by another caller in the meantime leaves
+// the lock of the other caller untouched. Locks are advisory: they only
+// exclude other callers of Lock and don't affect transactions.
+func (d *DB) Lock(ctx context.Context, object string) (UnlockFn, error) {
+	key := "lock_" + object
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b[:])
+	for {
+		err := d.WithinTx(ReadWrite, func(tx *Tx) error {
+			locked, err := tx.has(key)
+			if err != nil {
+				return err
+			}
+			if locked {
+				return errObjectLocked
+			}
+			return tx.tx.SetEntry(badger.NewEntry(
+				[]byte(key), []byte(token),
+			).WithTTL(d.lockTimeout))
+		})
+		switch {
+		case err == nil:
+			d.log.Debug("locked", slog.String("object", object))
+			return func() error {
+				return d.WithinTx(ReadWrite, func(tx *Tx) error {
+					v, err := tx.get(key)
+					if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+						return err
+					}
+					if v != token {
+						d.log.Debug(
+							"lock expired before release",
+							slog.String("object", object),
+						)
+						return nil
+					}
+					return tx.delete(key)
+				})
+			}, nil
+		case !errors.Is(err, errObjectLocked) &&
+			!errors.Is(err, badger.ErrConflict):
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// clearStaleLocks deletes all locks, which can only be left over from
+// a previous process since badger doesn't allow more than one process
+// to open a directory for writing. Read-only databases are left untouched.
+func (d *DB) clearStaleLocks() error {
+	if d.readOnly {
+		return nil
+	}
+	return d.withinTx(context.Background(), ReadWrite, false, func(
+		tx *Tx,
+	) error {
+		var keys []string
+		if err := tx.scanPrefix("lock_", func(key, _ string) error {
+			keys = append(keys, key)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := tx.delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// errObjectLocked is returned internally while Lock waits for a lock
+// held by another caller.
+var errObjectLocked = errors.New("object locked")
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUnlockAfterExpiry(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	unlock, err := db.Lock(ctx, "apple")
+	if err != nil {
+		t.Fatalf("locking: %v", err)
+	}
+	// Simulate the lock expiring and being acquired by another caller
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.set("lock_apple", "other")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatalf("unlocking: %v", err)
+	}
+	if err := db.WithinTx(ReadOnly, func(tx *Tx) error {
+		v, err := tx.get("lock_apple")
+		if err == nil && v != "other" {
+			t.Errorf("expected the lock of the other caller, got %q", v)
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("reading lock: %v", err)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := db.Lock(tctx, "apple"); !errors.Is(
+		err, context.DeadlineExceeded,
+	) {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+}
+
+func TestLockUnlock(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	unlock, err := db.Lock(ctx, "apple")
+	if err != nil {
+		t.Fatalf("locking: %v", err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatalf("unlocking: %v", err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	unlock, err = db.Lock(tctx, "apple")
+	if err != nil {
+		t.Fatalf("locking again: %v", err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatalf("unlocking: %v", err)
+	}
+}
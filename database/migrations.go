@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// schemaVersionKey is the key of the database schema version.
+const schemaVersionKey = "db_schema_version"
+
+// DBMigration migrates the database schema to Version.
+type DBMigration struct {
+	Version int
+	Migrate func(*badger.DB) error
+}
+
+// OpenWithMigrations is similar to Open but also applies all migrations
+// with a version greater than the current schema version of the database
+// in ascending order of their versions. The schema version is written after
+// each successful migration, so if a migration fails the database is left
+// at the version of the last successful migration and the database
+// is closed.
+func OpenWithMigrations(
+	ctx context.Context,
+	dir string,
+	l *slog.Logger,
+	migrations []DBMigration,
+	opts ...Option,
+) (*DB, error) {
+	d, err := Open(dir, l, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.migrate(ctx, migrations); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// SchemaVersion returns the current schema version of the database.
+func (d *DB) SchemaVersion() (version int, err error) {
+	err = d.WithinTx(ReadOnly, func(tx *Tx) error {
+		v, err := tx.get(schemaVersionKey)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+			return err
+		}
+		if version, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("parsing schema version: %w", err)
+		}
+		return nil
+	})
+	return
+}
+
+func (d *DB) migrate(ctx context.Context, migrations []DBMigration) error {
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	m := make([]DBMigration, len(migrations))
+	copy(m, migrations)
+	sort.Slice(m, func(i, j int) bool { return m[i].Version < m[j].Version })
+
+	for _, m := range m {
+		if m.Version <= current {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		d.log.Info(
+			"migrating schema",
+			slog.Int("from", current), slog.Int("to", m.Version),
+		)
+		if err := m.Migrate(d.db); err != nil {
+			return fmt.Errorf("migrating to version %d: %w", m.Version, err)
+		}
+		if err := d.withinTx(ctx, ReadWrite, false, func(tx *Tx) error {
+			return tx.set(schemaVersionKey, strconv.Itoa(m.Version))
+		}); err != nil {
+			return fmt.Errorf("writing schema version %d: %w", m.Version, err)
+		}
+		current = m.Version
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// markMigration returns a migration writing the key "migrated_<version>".
+func markMigration(version int) DBMigration {
+	return DBMigration{
+		Version: version,
+		Migrate: func(db *badger.DB) error {
+			return db.Update(func(txn *badger.Txn) error {
+				k := fmt.Sprintf("migrated_%d", version)
+				return txn.Set([]byte(k), []byte("1"))
+			})
+		},
+	}
+}
+
+func TestOpenWithMigrations(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db, err := OpenWithMigrations(
+		context.Background(), "", l,
+		// Migrations are applied in the order of their versions
+		[]DBMigration{markMigration(3), markMigration(1), markMigration(2)},
+	)
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	defer db.Close()
+
+	if v, err := db.SchemaVersion(); err != nil {
+		t.Fatalf("reading schema version: %v", err)
+	} else if v != 3 {
+		t.Fatalf("expected schema version 3, got %d", v)
+	}
+	err = db.WithinTx(ReadOnly, func(tx *Tx) error {
+		for v := 1; v <= 3; v++ {
+			if ok, err := tx.has(fmt.Sprintf("migrated_%d", v)); err != nil {
+				return err
+			} else if !ok {
+				t.Errorf("migration %d not applied", v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenWithMigrationsFailure(t *testing.T) {
+	ctx := context.Background()
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	errMigration := errors.New("migration failed")
+
+	_, err := OpenWithMigrations(ctx, dir, l, []DBMigration{
+		markMigration(1),
+		markMigration(2),
+		{Version: 3, Migrate: func(*badger.DB) error { return errMigration }},
+	})
+	if !errors.Is(err, errMigration) {
+		t.Fatalf("expected the migration error, got %v", err)
+	}
+
+	// The database is left at the last successful migration
+	db, err := Open(dir, l)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer db.Close()
+	if v, err := db.SchemaVersion(); err != nil {
+		t.Fatalf("reading schema version: %v", err)
+	} else if v != 2 {
+		t.Fatalf("expected schema version 2, got %d", v)
+	}
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// SnapshotIterator iterates over all objects of a point-in-time snapshot
+// of the database and can be reset to iterate over the exact same objects
+// again even if the database was modified in the meantime.
+//
+//	for it.Next() {
+//		object, quantity := it.Object()
+//	}
+//	if err := it.Err(); err != nil {
+//		// Handle error
+//	}
+type SnapshotIterator struct {
+	ctx     context.Context
+	tx      *badger.Txn
+	it      *badger.Iterator
+	started bool
+	object  string
+	quant   int64
+	err     error
+}
+
+// NewSnapshotIterator creates a new snapshot iterator positioned before
+// the first object. The iterator stops once ctx is canceled.
+// The iterator must be closed after use.
+func (d *DB) NewSnapshotIterator(
+	ctx context.Context,
+) (*SnapshotIterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx := d.db.NewTransaction(false)
+	return &SnapshotIterator{
+		ctx: ctx,
+		tx:  tx,
+		it:  tx.NewIterator(badger.DefaultIteratorOptions),
+	}, nil
+}
+
+// Next advances the iterator to the next object and returns false
+// if there are no more objects or the iteration failed.
+func (s *SnapshotIterator) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	if s.err = s.ctx.Err(); s.err != nil {
+		return false
+	}
+	p := []byte("o_")
+	if !s.started {
+		s.it.Seek(p)
+		s.started = true
+	} else {
+		s.it.Next()
+	}
+	if !s.it.ValidForPrefix(p) {
+		return false
+	}
+	i := s.it.Item()
+	if s.err = i.Value(func(v []byte) (err error) {
+		s.quant, err = strconv.ParseInt(string(v), 10, 64)
+		return err
+	}); s.err != nil {
+		s.err = fmt.Errorf("parsing scanned quantity: %w", s.err)
+		return false
+	}
+	s.object = string(i.Key()[len(p):])
+	return true
+}
+
+// Object returns the object the iterator is currently positioned at.
+func (s *SnapshotIterator) Object() (object string, quantity int64) {
+	return s.object, s.quant
+}
+
+// Err returns the error the iteration failed with, if any.
+func (s *SnapshotIterator) Err() error { return s.err }
+
+// Reset positions the iterator before the first object again.
+// Resetting an iterator that hasn't been advanced yet is a no-op.
+func (s *SnapshotIterator) Reset() {
+	s.started, s.object, s.quant, s.err = false, "", 0, nil
+}
+
+// Close closes the iterator and discards its transaction.
+func (s *SnapshotIterator) Close() error {
+	s.it.Close()
+	s.tx.Discard()
+	return nil
+}
@@ -0,0 +1,44 @@
+package database
+
+import (
+	"github.com/dgraph-io/badger/v3"
+)
+
+// DBStats are storage statistics of the database.
+type DBStats struct {
+	// KeyCount is the number of keys including companion
+	// and metadata keys.
+	KeyCount int64 `json:"key_count"`
+
+	ObjectCount int64 `json:"object_count"`
+
+	// DiskUsageBytes is the size of the LSM tree and the value log,
+	// which badger only updates periodically.
+	DiskUsageBytes int64 `json:"disk_usage_bytes"`
+	LSMSizeBytes   int64 `json:"lsm_size_bytes"`
+}
+
+// Stats counts all keys within a read-only transaction and returns them
+// along with the number of objects read by ObjectCount
+// and the on-disk size of the database.
+func (d *DB) Stats() (s DBStats, err error) {
+	lsm, vlog := d.db.Size()
+	s.LSMSizeBytes, s.DiskUsageBytes = lsm, lsm+vlog
+
+	err = d.WithinTx(ReadOnly, func(tx *Tx) error {
+		s.KeyCount = 0
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		i := tx.tx.NewIterator(opts)
+		defer i.Close()
+		for i.Rewind(); i.Valid(); i.Next() {
+			s.KeyCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return DBStats{}, err
+	}
+	s.ObjectCount, err = d.ObjectCount()
+	return
+}
@@ -0,0 +1,31 @@
+package database
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.WithinTx(ReadWrite, func(tx *Tx) error {
+		return tx.SetProjectionVersionBatch("0a", map[string]int64{
+			"apple": 1, "pear": 2, "kiwi": 3,
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.Stats()
+	if err != nil {
+		t.Fatalf("reading stats: %v", err)
+	}
+	if s.ObjectCount != 3 {
+		t.Errorf("expected 3 objects, got %d", s.ObjectCount)
+	}
+	if n, err := db.ObjectCount(); err != nil {
+		t.Fatalf("counting objects: %v", err)
+	} else if n != s.ObjectCount {
+		t.Errorf("ObjectCount returned %d, Stats %d", n, s.ObjectCount)
+	}
+	// The version key and its history record are stored alongside
+	if s.KeyCount <= s.ObjectCount {
+		t.Errorf("expected more keys than objects, got %d keys", s.KeyCount)
+	}
+}
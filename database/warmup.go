@@ -0,0 +1,47 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// warmUpProgressInterval is the number of keys
+// after which the warm-up progress is reported.
+const warmUpProgressInterval = 10000
+
+// WithWarmUpProgress makes WarmUp call fn with the number of keys read
+// every 10000 keys and once after the warm-up is completed.
+func WithWarmUpProgress(fn func(keysRead int64)) Option {
+	return func(d *DB) { d.warmUpProgress = fn }
+}
+
+// WarmUp iterates over all keys of the database without reading their
+// values to populate the block cache, which speeds up subsequent reads
+// after a cold start. WarmUp returns ctx.Err() if ctx is canceled before
+// the warm-up is completed.
+func (d *DB) WarmUp(ctx context.Context) error {
+	return d.WithinTxContext(ctx, ReadOnly, func(tx *Tx) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		i := tx.tx.NewIterator(opts)
+		defer i.Close()
+
+		var n int64
+		for i.Rewind(); i.Valid(); i.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if n++; n%warmUpProgressInterval == 0 &&
+				d.warmUpProgress != nil {
+				d.warmUpProgress(n)
+			}
+		}
+		if d.warmUpProgress != nil {
+			d.warmUpProgress(n)
+		}
+		d.log.Info("warmed up", slog.Int64("keys_read", n))
+		return nil
+	})
+}
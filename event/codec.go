@@ -0,0 +1,43 @@
+package event
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// Codec encodes and decodes event payloads.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is a Codec based on encoding/json.
+type JSONCodec struct{}
+
+func (*JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (*JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// codecHolder wraps Codec since atomic.Value requires
+// all stored values to be of the same concrete type.
+type codecHolder struct{ Codec }
+
+var defaultCodec atomic.Value
+
+func init() { defaultCodec.Store(codecHolder{&JSONCodec{}}) }
+
+// DefaultCodec returns the codec used by Encode, Decode and EncodeCheckpoint.
+// The default codec is JSONCodec.
+func DefaultCodec() Codec {
+	return defaultCodec.Load().(codecHolder).Codec
+}
+
+// SetDefaultCodec sets the codec used by Encode, Decode and EncodeCheckpoint.
+// It's safe for concurrent use.
+func SetDefaultCodec(c Codec) {
+	defaultCodec.Store(codecHolder{c})
+}
@@ -1,8 +1,8 @@
 package event
 
 import (
-	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/romshark/eventlog/client"
 )
@@ -10,29 +10,166 @@ import (
 type Event struct {
 	Operation string `json:"-"`
 	Object    string `json:"object"`
-	Quantity  int64  `json:"quantity"`
+
+	// Quantity is negative for "adjust" events removing objects.
+	Quantity int64 `json:"quantity"`
+
+	// ExpiresAt is the expiry time scheduled by "expire" events.
+	// On "take" events it identifies the expiry drained by the take.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Source and Destination are the objects of "transfer" events.
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+
+	// ReservationID identifies the reservation of "reserve"
+	// and "release" events.
+	ReservationID string `json:"reservation_id,omitempty"`
+
+	// Take converts the reservation of a "release" event
+	// into a take instead of canceling it.
+	Take bool `json:"take,omitempty"`
+
+	// Items maps objects to quantities of "bulk-put" and "bulk-take" events.
+	Items map[string]int64 `json:"items,omitempty"`
+
+	// IdempotencyKey makes consumers skip all but the first event
+	// carrying the same key. Empty means no idempotency.
+	IdempotencyKey string `json:"idem_key,omitempty"`
+
+	// TraceContext is the base64-encoded W3C trace parent of the span
+	// the event was appended within (see package otel).
+	TraceContext string `json:"trace_ctx,omitempty"`
+
+	// Meta holds contextual annotations such as a user or request ID,
+	// which don't affect how the event is applied.
+	Meta map[string]string `json:"meta,omitempty"`
+
+	// RecordedAt is the time the event occurred at and is zero for events
+	// recorded before the field was introduced.
+	RecordedAt time.Time `json:"-"`
 }
 
+// payload is the encoded representation of an Event.
+// RecordedAt is encoded as Unix nanoseconds.
+type payload struct {
+	Event
+	RecordedAt int64 `json:"recorded_at,omitempty"`
+}
+
+// IsKnownLabel returns true if label is a known event type.
+func IsKnownLabel(label string) bool {
+	switch label {
+	case "put", "take", "set", "adjust", "bulk-put", "bulk-take", "transfer",
+		"reserve", "release", "expire", "checkpoint":
+		return true
+	}
+	return false
+}
+
+// UnknownEventError is returned by Decode for events with unknown labels,
+// which are usually emitted by newer producers.
+type UnknownEventError struct {
+	Label []byte
+}
+
+func (e UnknownEventError) Error() string {
+	return fmt.Sprintf("unknown event type: %q", e.Label)
+}
+
+// Decode decodes i using the default codec.
 func Decode(i client.Event) (e Event, err error) {
-	switch string(i.Label) {
-	case "put", "take":
-		e.Operation = string(i.Label)
-	default:
-		return Event{}, fmt.Errorf("unknown event type: %q", i.Label)
+	return DecodeWith(i, DefaultCodec())
+}
+
+// DecodeWith decodes i using codec c.
+func DecodeWith(i client.Event, c Codec) (e Event, err error) {
+	if !IsKnownLabel(string(i.Label)) {
+		return Event{}, UnknownEventError{Label: i.Label}
+	}
+	e.Operation = string(i.Label)
+	if e.Operation == "checkpoint" {
+		// Checkpoints don't refer to any object
+		return
+	}
+	var p payload
+	if err = c.Unmarshal(i.PayloadJSON, &p); err != nil {
+		return Event{}, err
+	}
+	p.Event.Operation = e.Operation
+	e = p.Event
+	if p.RecordedAt != 0 {
+		e.RecordedAt = time.Unix(0, p.RecordedAt)
+	}
+	if e.Operation == "expire" && e.ExpiresAt == nil {
+		return Event{}, fmt.Errorf("missing expiry time: %s", i.PayloadJSON)
+	}
+	if e.Operation == "transfer" && (e.Source == "" || e.Destination == "") {
+		return Event{}, fmt.Errorf(
+			"missing transfer objects: %s", i.PayloadJSON,
+		)
+	}
+	if isBulk(e.Operation) && len(e.Items) < 1 {
+		return Event{}, fmt.Errorf("missing items: %s", i.PayloadJSON)
+	}
+	return
+}
+
+// Checkpoint is the payload of a "checkpoint" event, which doesn't modify
+// any objects and only marks a version consumers can synchronize to.
+type Checkpoint struct {
+	ProducerID string    `json:"producer_id"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// EncodeCheckpoint encodes c using the default codec.
+func EncodeCheckpoint(c Checkpoint) (e client.EventData, err error) {
+	if e.PayloadJSON, err = DefaultCodec().Marshal(c); err != nil {
+		return
 	}
-	err = json.Unmarshal(i.PayloadJSON, &e)
+	e.Label = []byte("checkpoint")
 	return
 }
 
+// Encode encodes i using the default codec.
 func Encode(i Event) (e client.EventData, err error) {
+	return EncodeWith(i, DefaultCodec())
+}
+
+// EncodeWith encodes i using codec c.
+// RecordedAt is set to the current time if it's zero.
+func EncodeWith(i Event, c Codec) (e client.EventData, err error) {
 	switch i.Operation {
-	case "put", "take":
+	case "put", "take", "set", "adjust", "reserve", "release":
+	case "expire":
+		if i.ExpiresAt == nil {
+			return client.EventData{}, fmt.Errorf("missing expiry time: %#v", i)
+		}
+	case "transfer":
+		if i.Source == "" || i.Destination == "" {
+			return client.EventData{}, fmt.Errorf(
+				"missing transfer objects: %#v", i,
+			)
+		}
+	case "bulk-put", "bulk-take":
+		if len(i.Items) < 1 {
+			return client.EventData{}, fmt.Errorf("missing items: %#v", i)
+		}
 	default:
 		return client.EventData{}, fmt.Errorf("unknown event type: %#v", i)
 	}
-	if e.PayloadJSON, err = json.Marshal(i); err != nil {
+	if i.RecordedAt.IsZero() {
+		i.RecordedAt = time.Now()
+	}
+	p := payload{Event: i, RecordedAt: i.RecordedAt.UnixNano()}
+	if e.PayloadJSON, err = c.Marshal(p); err != nil {
 		return
 	}
 	e.Label = []byte(i.Operation)
 	return
 }
+
+// isBulk returns true for operations affecting multiple objects.
+func isBulk(operation string) bool {
+	return operation == "bulk-put" || operation == "bulk-take"
+}
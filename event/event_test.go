@@ -0,0 +1,73 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/romshark/eventlog/client"
+)
+
+func TestMetaRoundTrip(t *testing.T) {
+	in := Event{
+		Operation:  "put",
+		Object:     "apple",
+		Quantity:   3,
+		Meta:       map[string]string{"user": "alice", "request": "r1"},
+		RecordedAt: time.Unix(0, 42),
+	}
+	e, err := Encode(in)
+	if err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+	out, err := Decode(client.Event{EventData: e})
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if !reflect.DeepEqual(out.Meta, in.Meta) {
+		t.Fatalf("expected meta %v, got %v", in.Meta, out.Meta)
+	}
+	if out.Object != in.Object || out.Quantity != in.Quantity ||
+		!out.RecordedAt.Equal(in.RecordedAt) {
+		t.Fatalf("expected %#v, got %#v", in, out)
+	}
+}
+
+func TestEncodeWithoutMeta(t *testing.T) {
+	e, err := Encode(Event{
+		Operation:  "put",
+		Object:     "apple",
+		Quantity:   3,
+		RecordedAt: time.Unix(0, 42),
+	})
+	if err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(e.PayloadJSON, &fields); err != nil {
+		t.Fatalf("unmarshaling %s: %v", e.PayloadJSON, err)
+	}
+	if _, ok := fields["meta"]; ok {
+		t.Fatalf("expected no meta field, got %s", e.PayloadJSON)
+	}
+	const want = `{"object":"apple","quantity":3,"recorded_at":42}`
+	if string(e.PayloadJSON) != want {
+		t.Fatalf("expected %s, got %s", want, e.PayloadJSON)
+	}
+}
+
+func TestDecodeUnknownLabel(t *testing.T) {
+	_, err := Decode(client.Event{EventData: client.EventData{
+		Label:       []byte("future"),
+		PayloadJSON: []byte(`{"object":"apple"}`),
+	}})
+	var errUnknown UnknownEventError
+	if !errors.As(err, &errUnknown) {
+		t.Fatalf("expected UnknownEventError, got %v", err)
+	}
+	if string(errUnknown.Label) != "future" {
+		t.Fatalf("expected label future, got %q", errUnknown.Label)
+	}
+}
@@ -0,0 +1,156 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/romshark/eventlog/client"
+)
+
+// EventType is an event label.
+type EventType string
+
+// EventStream scans the event log using a single connection
+// and fans out all scanned events to the receivers registered
+// for the label of the event.
+type EventStream struct {
+	c *client.Client
+
+	lock      sync.Mutex
+	receivers map[EventType][]chan<- client.Event
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error
+}
+
+// NewEventStream creates a new event stream reading from c.
+func NewEventStream(c *client.Client) *EventStream {
+	return &EventStream{
+		c:         c,
+		receivers: map[EventType][]chan<- client.Event{},
+	}
+}
+
+// Register makes ch receive all events labeled label.
+// ch is closed when the stream is stopped.
+func (s *EventStream) Register(label EventType, ch chan<- client.Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.receivers[label] = append(s.receivers[label], ch)
+}
+
+// Start begins scanning the log from its initial version in a background
+// goroutine and keeps listening for new events until either Stop is called
+// or ctx is canceled.
+func (s *EventStream) Start(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done != nil {
+		return ErrStreamStarted
+	}
+
+	initial, err := s.c.VersionInitial(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		err := s.run(ctx, initial)
+		if errors.Is(err, context.Canceled) {
+			err = nil
+		}
+		s.lock.Lock()
+		s.err = err
+		s.lock.Unlock()
+	}()
+	return nil
+}
+
+// Stop stops the stream, closes all registered channels and returns
+// the error the stream stopped with, if any.
+func (s *EventStream) Stop() error {
+	s.lock.Lock()
+	cancel, done := s.cancel, s.done
+	s.lock.Unlock()
+	if done != nil {
+		cancel()
+		<-done
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for l, r := range s.receivers {
+		for _, ch := range r {
+			close(ch)
+		}
+		delete(s.receivers, l)
+	}
+	return s.err
+}
+
+func (s *EventStream) run(ctx context.Context, initial client.Version) error {
+	var last client.Version
+	scan := func() error {
+		from := last
+		if from == "" {
+			if initial == "0" {
+				// The log was empty when the stream was started
+				v, err := s.c.VersionInitial(ctx)
+				if err != nil {
+					return err
+				}
+				if v == "0" {
+					return nil
+				}
+				initial = v
+			}
+			from = initial
+		}
+		return s.c.Scan(ctx, from, false, func(e client.Event) error {
+			if e.Version == last {
+				// Ignore the last dispatched version
+				return nil
+			}
+			if err := s.dispatch(ctx, e); err != nil {
+				return err
+			}
+			last = e.Version
+			return nil
+		})
+	}
+
+	if err := scan(); err != nil {
+		return err
+	}
+	var errScan error
+	err := s.c.Listen(ctx, func(client.Version) {
+		if errScan = scan(); errScan != nil {
+			s.cancel()
+		}
+	})
+	if errScan != nil {
+		return errScan
+	}
+	return err
+}
+
+// dispatch sends e to all receivers registered for its label.
+func (s *EventStream) dispatch(ctx context.Context, e client.Event) error {
+	s.lock.Lock()
+	r := s.receivers[EventType(e.Label)]
+	s.lock.Unlock()
+	for _, ch := range r {
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+var ErrStreamStarted = errors.New("stream already started")
@@ -0,0 +1,123 @@
+// Package projection provides the parts of the projection
+// shared by the producer and the consumer.
+package projection
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+
+	"github.com/romshark/eventlog-example/database"
+
+	"github.com/romshark/eventlog/client"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+// VersionAt returns the version at which object was last modified.
+// An empty version is returned if object was stored without a version.
+// ErrObjectNotFound is returned if object doesn't exist.
+func VersionAt(
+	ctx context.Context,
+	tx *database.Tx,
+	object string,
+) (client.Version, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	ok, err := tx.Has(object)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrObjectNotFound
+	}
+	return tx.GetObjectVersion(object)
+}
+
+// Audit returns at most limit of the most recent operations applied
+// to the projection starting with the most recent one.
+func Audit(
+	tx *database.Tx,
+	limit int,
+) (entries []database.AuditEntry, err error) {
+	err = tx.ScanAudit(func(e database.AuditEntry) error {
+		if len(entries) >= limit {
+			return database.ErrAbortScan
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return
+}
+
+// ApplyReserved adds delta to the reserved quantity of object
+// and to the quantity reserved by reservation id.
+func ApplyReserved(
+	log *slog.Logger,
+	tx *database.Tx,
+	id string,
+	object string,
+	delta int64,
+) error {
+	reserved, err := tx.GetReserved(object)
+	if err != nil {
+		return err
+	}
+	log.Debug(
+		"updating reserved",
+		slog.String("object", object),
+		slog.String("reservation_id", id),
+		slog.Int64("from", reserved),
+		slog.Int64("to", reserved+delta),
+	)
+	if reserved+delta < 1 {
+		err = tx.DeleteReserved(object)
+	} else {
+		err = tx.SetReserved(object, reserved+delta)
+	}
+	if err != nil {
+		return err
+	}
+	_, q, _, err := tx.GetReservation(id)
+	if err != nil {
+		return err
+	}
+	if q+delta < 1 {
+		return tx.DeleteReservation(id)
+	}
+	return tx.SetReservation(id, object, q+delta)
+}
+
+// RecoverEntry checks whether the entry of object is consistent
+// and rewrites it with the given quantity if it was only partially written.
+func RecoverEntry(
+	log *slog.Logger,
+	tx *database.Tx,
+	object string,
+	quantity int64,
+) error {
+	exists, err := tx.Exists(object)
+	if err != nil || exists {
+		return err
+	}
+	has, err := tx.Has(object)
+	if err != nil || !has {
+		return err
+	}
+	log.Info(
+		"recovering inconsistent entry", slog.String("object", object),
+	)
+	return tx.Set(object, quantity)
+}
+
+// SortedObjects returns the objects of items in lexicographical order.
+func SortedObjects(items map[string]int64) []string {
+	objects := make([]string, 0, len(items))
+	for o := range items {
+		objects = append(objects, o)
+	}
+	sort.Strings(objects)
+	return objects
+}
@@ -0,0 +1,121 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"github.com/romshark/eventlog-example/database"
+)
+
+func newTestDB(t *testing.T) (*database.DB, *slog.Logger) {
+	t.Helper()
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db, err := database.Open("", l)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, l
+}
+
+func TestVersionAt(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestDB(t)
+	if err := db.WithinTx(database.ReadWrite, func(tx *database.Tx) error {
+		return tx.SetWithVersion("apple", 1, "5")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		v, err := VersionAt(ctx, tx, "apple")
+		if err != nil {
+			return err
+		}
+		if v != "5" {
+			t.Errorf("expected version 5, got %q", v)
+		}
+		if _, err := VersionAt(ctx, tx, "pear"); !errors.Is(
+			err, ErrObjectNotFound,
+		) {
+			t.Errorf("expected ErrObjectNotFound, got %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	db, _ := newTestDB(t)
+	if err := db.WithinTx(database.ReadWrite, func(tx *database.Tx) error {
+		for _, v := range []string{"1", "2", "3"} {
+			if err := tx.SetAuditEntry(database.AuditEntry{
+				Version: v, Operation: "put", Object: "apple", Quantity: 1,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.WithinTx(database.ReadOnly, func(tx *database.Tx) error {
+		entries, err := Audit(tx, 2)
+		if err != nil {
+			return err
+		}
+		var versions []string
+		for _, e := range entries {
+			versions = append(versions, e.Version)
+		}
+		if !reflect.DeepEqual(versions, []string{"3", "2"}) {
+			t.Errorf("expected versions [3 2], got %v", versions)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyReserved(t *testing.T) {
+	db, l := newTestDB(t)
+	if err := db.WithinTx(database.ReadWrite, func(tx *database.Tx) error {
+		if err := ApplyReserved(l, tx, "r1", "apple", 3); err != nil {
+			return err
+		}
+		if err := ApplyReserved(l, tx, "r2", "apple", 2); err != nil {
+			return err
+		}
+		if r, err := tx.GetReserved("apple"); err != nil || r != 5 {
+			t.Errorf("expected 5 reserved, got %d (%v)", r, err)
+		}
+
+		// Releasing the entire reservation deletes it
+		if err := ApplyReserved(l, tx, "r1", "apple", -3); err != nil {
+			return err
+		}
+		if _, _, ok, err := tx.GetReservation("r1"); err != nil || ok {
+			t.Errorf("expected r1 to be deleted (%v)", err)
+		}
+		if r, err := tx.GetReserved("apple"); err != nil || r != 2 {
+			t.Errorf("expected 2 reserved, got %d (%v)", r, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSortedObjects(t *testing.T) {
+	got := SortedObjects(map[string]int64{"pear": 1, "apple": 2, "kiwi": 3})
+	want := []string{"apple", "kiwi", "pear"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,82 @@
+// Package runner runs the long-running loops of the binaries
+// restarting them after panics.
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var ErrMaxRestartsExceeded = errors.New("maximum number of restarts exceeded")
+
+// Option configures RunWithRecovery.
+type Option func(*options)
+
+type options struct {
+	restartDelay time.Duration
+	maxRestarts  int
+}
+
+// WithRestartDelay sets the delay after which RunWithRecovery
+// restarts run after a panic. The default delay is one second.
+func WithRestartDelay(d time.Duration) Option {
+	return func(o *options) { o.restartDelay = d }
+}
+
+// WithMaxRestarts limits the number of times RunWithRecovery restarts run
+// after a panic. By default the number of restarts is unlimited.
+func WithMaxRestarts(n int) Option {
+	return func(o *options) { o.maxRestarts = n }
+}
+
+// RunWithRecovery calls run and restarts it after the restart delay
+// whenever it panics, calling onPanic with the recovered value.
+// A wrapped ErrMaxRestartsExceeded is returned once run panics again
+// after the maximum number of restarts set by WithMaxRestarts.
+func RunWithRecovery(
+	ctx context.Context,
+	log *slog.Logger,
+	run func(context.Context) error,
+	onPanic func(r interface{}),
+	opts ...Option,
+) error {
+	o := options{restartDelay: time.Second, maxRestarts: -1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	for restarts := 0; ; restarts++ {
+		panicked, err := runRecovering(ctx, run, onPanic)
+		if !panicked {
+			return err
+		}
+		if o.maxRestarts >= 0 && restarts >= o.maxRestarts {
+			return fmt.Errorf(
+				"%w: %d restarts", ErrMaxRestartsExceeded, restarts,
+			)
+		}
+		log.Info("restarting", slog.Duration("delay", o.restartDelay))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(o.restartDelay):
+		}
+	}
+}
+
+// runRecovering calls run recovering from any panic.
+func runRecovering(
+	ctx context.Context,
+	run func(context.Context) error,
+	onPanic func(r interface{}),
+) (panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			onPanic(r)
+		}
+	}()
+	return false, run(ctx)
+}
@@ -0,0 +1,65 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestRunWithRecovery(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	errDone := errors.New("done")
+
+	var runs, panics int
+	err := RunWithRecovery(
+		context.Background(), l,
+		func(context.Context) error {
+			if runs++; runs < 3 {
+				panic("boom")
+			}
+			return errDone
+		},
+		func(r interface{}) { panics++ },
+		WithRestartDelay(0),
+	)
+	if !errors.Is(err, errDone) {
+		t.Fatalf("expected errDone, got %v", err)
+	}
+	if runs != 3 || panics != 2 {
+		t.Fatalf("expected 3 runs and 2 panics, got %d and %d", runs, panics)
+	}
+}
+
+func TestRunWithRecoveryMaxRestarts(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var runs int
+	err := RunWithRecovery(
+		context.Background(), l,
+		func(context.Context) error { runs++; panic("boom") },
+		func(r interface{}) {},
+		WithRestartDelay(0), WithMaxRestarts(2),
+	)
+	if !errors.Is(err, ErrMaxRestartsExceeded) {
+		t.Fatalf("expected ErrMaxRestartsExceeded, got %v", err)
+	}
+	if runs != 3 {
+		t.Fatalf("expected 3 runs, got %d", runs)
+	}
+}
+
+func TestRunWithRecoveryCanceled(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := RunWithRecovery(
+		ctx, l,
+		func(context.Context) error { panic("boom") },
+		func(r interface{}) { cancel() },
+	)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Package metrics provides the Prometheus metrics
+// of producers and consumers.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/romshark/eventlog/client"
+)
+
+// Metrics are the Prometheus metrics of a producer or consumer.
+// All methods are no-ops on a nil *Metrics.
+type Metrics struct {
+	EventsApplied  prometheus.Counter
+	EventsAppended prometheus.Counter
+
+	// AppendRetries counts the synchronizations caused by
+	// optimistic concurrency conflicts during TryAppend.
+	AppendRetries prometheus.Counter
+
+	SyncDuration prometheus.Histogram
+
+	// ProjectionLag is the difference between the latest event log
+	// version and the version projected by the database.
+	ProjectionLag prometheus.Gauge
+}
+
+// New creates metrics with names prefixed by namespace.
+func New(namespace string) *Metrics {
+	return &Metrics{
+		EventsApplied: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_applied_total",
+			Help:      "Number of events applied to the projection.",
+		}),
+		EventsAppended: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_appended_total",
+			Help:      "Number of events appended to the event log.",
+		}),
+		AppendRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "append_retries_total",
+			Help:      "Number of appends retried due to outdated projections.",
+		}),
+		SyncDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "sync_duration_seconds",
+			Help:      "Duration of synchronizations against the event log.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		ProjectionLag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "projection_lag",
+			Help: "Difference between the latest event log version " +
+				"and the projected version.",
+		}),
+	}
+}
+
+// Register registers all metrics with r.
+func (m *Metrics) Register(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		m.EventsApplied,
+		m.EventsAppended,
+		m.AppendRetries,
+		m.SyncDuration,
+		m.ProjectionLag,
+	} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddApplied adds n to the number of applied events.
+func (m *Metrics) AddApplied(n int) {
+	if m != nil {
+		m.EventsApplied.Add(float64(n))
+	}
+}
+
+// AddAppended adds n to the number of appended events.
+func (m *Metrics) AddAppended(n int) {
+	if m != nil {
+		m.EventsAppended.Add(float64(n))
+	}
+}
+
+// IncAppendRetries increments the number of append retries.
+func (m *Metrics) IncAppendRetries() {
+	if m != nil {
+		m.AppendRetries.Inc()
+	}
+}
+
+// ObserveSync records the duration of a synchronization.
+func (m *Metrics) ObserveSync(d time.Duration) {
+	if m != nil {
+		m.SyncDuration.Observe(d.Seconds())
+	}
+}
+
+// SetLag sets the projection lag to the difference between
+// the latest event log version and the projected version.
+// Versions that can't be parsed are ignored.
+func (m *Metrics) SetLag(latest, projected client.Version) {
+	if m == nil {
+		return
+	}
+	l, err := parseVersion(latest)
+	if err != nil {
+		return
+	}
+	p, err := parseVersion(projected)
+	if err != nil {
+		return
+	}
+	m.ProjectionLag.Set(float64(l) - float64(p))
+}
+
+// parseVersion parses hexadecimal version v.
+// An empty version is the version preceding the first event.
+func parseVersion(v client.Version) (uint64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(v, 16, 64)
+}
@@ -0,0 +1,63 @@
+// Package otel propagates OpenTelemetry trace contexts through events.
+package otel
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/romshark/eventlog-example/event"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceParentHeader is the W3C trace context header carried by events.
+const traceParentHeader = "traceparent"
+
+var propagator = propagation.TraceContext{}
+
+// Tracer returns the tracer of the globally registered tracer provider,
+// which doesn't record any spans unless a provider is registered.
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/romshark/eventlog-example")
+}
+
+// End records err on span unless it's nil and ends span.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InjectTraceContext returns e carrying the base64-encoded W3C trace
+// parent of the span in ctx. e is returned unchanged if ctx carries
+// no valid span context.
+func InjectTraceContext(e event.Event, ctx context.Context) event.Event {
+	c := propagation.MapCarrier{}
+	propagator.Inject(ctx, c)
+	if tp := c.Get(traceParentHeader); tp != "" {
+		e.TraceContext = base64.StdEncoding.EncodeToString([]byte(tp))
+	}
+	return e
+}
+
+// ExtractTraceContext returns a context carrying the remote span context
+// injected into e by InjectTraceContext. A context without a span context
+// is returned if e carries none or it's malformed.
+func ExtractTraceContext(e event.Event) context.Context {
+	ctx := context.Background()
+	if e.TraceContext == "" {
+		return ctx
+	}
+	tp, err := base64.StdEncoding.DecodeString(e.TraceContext)
+	if err != nil {
+		return ctx
+	}
+	return propagator.Extract(
+		ctx, propagation.MapCarrier{traceParentHeader: string(tp)},
+	)
+}
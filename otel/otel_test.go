@@ -0,0 +1,45 @@
+package otel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/romshark/eventlog-example/event"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceContextRoundTrip(t *testing.T) {
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+		SpanID:     trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+
+	e := InjectTraceContext(event.Event{Object: "apple"}, ctx)
+	if e.TraceContext == "" {
+		t.Fatalf("expected the trace context to be injected")
+	}
+	got := trace.SpanContextFromContext(ExtractTraceContext(e))
+	if !got.IsRemote() {
+		t.Errorf("expected a remote span context")
+	}
+	if got.TraceID() != sc.TraceID() || got.SpanID() != sc.SpanID() ||
+		got.TraceFlags() != sc.TraceFlags() {
+		t.Fatalf("expected %v, got %v", sc, got)
+	}
+}
+
+func TestTraceContextMissing(t *testing.T) {
+	e := InjectTraceContext(event.Event{Object: "apple"}, context.Background())
+	if e.TraceContext != "" {
+		t.Fatalf("expected no trace context, got %q", e.TraceContext)
+	}
+	for _, tc := range []string{"", "not base64!", "bm90IGEgdHJhY2VwYXJlbnQ="} {
+		ctx := ExtractTraceContext(event.Event{TraceContext: tc})
+		if trace.SpanContextFromContext(ctx).IsValid() {
+			t.Errorf("expected no span context for %q", tc)
+		}
+	}
+}